@@ -0,0 +1,3 @@
+module github.com/sunshinewithmoonlight/memubot-relay
+
+go 1.21
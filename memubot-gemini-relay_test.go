@@ -0,0 +1,1033 @@
+//go:build gemini
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试不经过 main 的 flag.Parse，这里补上被测路径依赖的默认值
+func TestMain(m *testing.M) {
+	outputFormat = "minimax"
+	blockedResponse = "error"
+	pickMode = "first"
+	signatureCache = newSignatureLRU(1024)
+	os.Exit(m.Run())
+}
+
+func mustMessages(t *testing.T, raw string) []GenericMessage {
+	t.Helper()
+	var msgs []GenericMessage
+	if err := json.Unmarshal([]byte(raw), &msgs); err != nil {
+		t.Fatalf("消息 fixture 解析失败: %v", err)
+	}
+	return msgs
+}
+
+func mustTools(t *testing.T, raw string) []GenericTool {
+	t.Helper()
+	var tools []GenericTool
+	if err := json.Unmarshal([]byte(raw), &tools); err != nil {
+		t.Fatalf("工具 fixture 解析失败: %v", err)
+	}
+	return tools
+}
+
+// --- 请求转换 (buildGoogleRequest) ---
+
+func TestBuildGoogleRequestTools(t *testing.T) {
+	cases := []struct {
+		name  string
+		tools string
+	}{
+		{
+			"openai-style",
+			`[{"type":"function","function":{"name":"get_weather","description":"查询城市天气","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}}]`,
+		},
+		{
+			"anthropic-style",
+			`[{"name":"get_weather","description":"查询城市天气","input_schema":{"type":"object","properties":{"city":{"type":"string"}}}}]`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			genReq := GenericRequest{
+				Model:    "gemini-2.5-flash",
+				Messages: mustMessages(t, `[{"role":"user","content":"北京天气如何"}]`),
+				Tools:    mustTools(t, tc.tools),
+			}
+			gReq, _ := buildGoogleRequest(genReq, "test-scope", "")
+			if len(gReq.Tools) != 1 || len(gReq.Tools[0].FunctionDeclarations) != 1 {
+				t.Fatalf("期望 1 个函数声明，得到 %+v", gReq.Tools)
+			}
+			decl := gReq.Tools[0].FunctionDeclarations[0]
+			if decl.Name != "get_weather" {
+				t.Errorf("函数名 = %q，期望 get_weather", decl.Name)
+			}
+			if decl.Description != "查询城市天气" {
+				t.Errorf("描述 = %q", decl.Description)
+			}
+			var params map[string]any
+			if err := json.Unmarshal(decl.Parameters, &params); err != nil {
+				t.Fatalf("参数 schema 不是合法 JSON: %v", err)
+			}
+			if _, ok := params["properties"]; !ok {
+				t.Errorf("参数 schema 丢失 properties: %s", decl.Parameters)
+			}
+		})
+	}
+}
+
+func TestBuildGoogleRequestToolResultMapping(t *testing.T) {
+	genReq := GenericRequest{
+		Model: "gemini-2.5-flash",
+		Messages: mustMessages(t, `[
+			{"role":"user","content":"北京天气如何"},
+			{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}]},
+			{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":"晴 25 度"}]}
+		]`),
+	}
+	gReq, _ := buildGoogleRequest(genReq, "test-scope", "")
+	if len(gReq.Contents) != 3 {
+		t.Fatalf("期望 3 条 contents，得到 %d", len(gReq.Contents))
+	}
+	last := gReq.Contents[2]
+	if last.Role != "user" {
+		t.Errorf("tool_result 应落在 user 角色，得到 %q", last.Role)
+	}
+	if len(last.Parts) != 1 || last.Parts[0].FunctionResponse == nil {
+		t.Fatalf("期望单个 functionResponse part，得到 %+v", last.Parts)
+	}
+	fr := last.Parts[0].FunctionResponse
+	if fr.Name != "get_weather" {
+		t.Errorf("functionResponse.Name = %q，期望按 tool_use_id 映射回 get_weather", fr.Name)
+	}
+	if got := fr.Response["result"]; got != "晴 25 度" {
+		t.Errorf("Response = %v，期望 {\"result\":\"晴 25 度\"}", fr.Response)
+	}
+}
+
+func TestBuildGoogleRequestMergesConsecutiveRoles(t *testing.T) {
+	genReq := GenericRequest{
+		Model: "gemini-2.5-flash",
+		Messages: mustMessages(t, `[
+			{"role":"user","content":"第一句"},
+			{"role":"user","content":"第二句"},
+			{"role":"assistant","content":"好的"},
+			{"role":"assistant","content":"请继续"}
+		]`),
+	}
+	gReq, _ := buildGoogleRequest(genReq, "test-scope", "")
+	if len(gReq.Contents) != 2 {
+		t.Fatalf("连续相同角色应合并为 2 条 contents，得到 %d: %+v", len(gReq.Contents), gReq.Contents)
+	}
+	if gReq.Contents[0].Role != "user" || len(gReq.Contents[0].Parts) != 2 {
+		t.Errorf("user 合并结果不对: %+v", gReq.Contents[0])
+	}
+	if gReq.Contents[1].Role != "model" || len(gReq.Contents[1].Parts) != 2 {
+		t.Errorf("model 合并结果不对: %+v", gReq.Contents[1])
+	}
+}
+
+func TestBuildGoogleRequestSystemAndDeveloper(t *testing.T) {
+	genReq := GenericRequest{
+		Model:  "gemini-2.5-flash",
+		System: json.RawMessage(`"保持简短"`),
+		Messages: mustMessages(t, `[
+			{"role":"developer","content":"用中文回答"},
+			{"role":"user","content":"ping"}
+		]`),
+	}
+	gReq, _ := buildGoogleRequest(genReq, "test-scope", "")
+	if gReq.SystemInstruction == nil || len(gReq.SystemInstruction.Parts) != 2 {
+		t.Fatalf("system + developer 应并入 systemInstruction，得到 %+v", gReq.SystemInstruction)
+	}
+	if len(gReq.Contents) != 1 || gReq.Contents[0].Role != "user" {
+		t.Errorf("会话内容应只剩 user 消息: %+v", gReq.Contents)
+	}
+}
+
+// --- 工具声明驻留注册表 (internToolDeclaration) ---
+
+// 驻留命中的声明必须与直接处理的结果逐字节一致，出站 payload 不能因缓存而变
+func TestInternToolDeclarationGolden(t *testing.T) {
+	schema := json.RawMessage(`{"type":"object","properties":{"path":{"type":"string","format":"uri"},"mode":{"anyOf":[{"type":"string"},{"type":"null"}]}},"additionalProperties":false}`)
+	direct := processToolDeclaration("fs_read", "读取文件", schema)
+	interned := internToolDeclaration("fs_read", "读取文件", schema)
+	cached := internToolDeclaration("fs_read", "读取文件", schema)
+
+	want, _ := json.Marshal(direct)
+	for _, d := range []geminiFunctionDeclaration{interned, cached} {
+		got, _ := json.Marshal(d)
+		if string(got) != string(want) {
+			t.Errorf("驻留声明与直接处理不一致:\n直接: %s\n驻留: %s", want, got)
+		}
+	}
+}
+
+// benchToolFixture 造一个 60 工具的请求样例，模拟大型 memU 配置
+func benchToolFixture() []GenericTool {
+	tools := make([]GenericTool, 60)
+	for i := range tools {
+		tools[i].Name = fmt.Sprintf("tool_%02d", i)
+		tools[i].Description = "基准测试工具"
+		tools[i].InputSchema = json.RawMessage(fmt.Sprintf(
+			`{"type":"object","properties":{"arg_%02d":{"type":"string","format":"uri"},"count":{"type":"integer"}},"additionalProperties":false}`, i))
+	}
+	return tools
+}
+
+func BenchmarkInternToolDeclaration60Tools(b *testing.B) {
+	tools := benchToolFixture()
+	// 预热：第一轮请求完成登记，基准测量的是后续请求的命中路径
+	for _, tl := range tools {
+		internToolDeclaration(tl.Name, tl.Description, tl.InputSchema)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tl := range tools {
+			internToolDeclaration(tl.Name, tl.Description, tl.InputSchema)
+		}
+	}
+}
+
+func BenchmarkProcessToolDeclaration60Tools(b *testing.B) {
+	tools := benchToolFixture()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tl := range tools {
+			processToolDeclaration(tl.Name, tl.Description, tl.InputSchema)
+		}
+	}
+}
+
+// --- Anthropic 导出的反向转换 (googleContentsToAnthropic) ---
+
+// 客户端消息 → Gemini contents → 导出消息走一个来回，角色、文本、
+// 工具调用配对都应还原（tool_use id 是导出时重新生成的规范 id）
+func TestAnthropicExportRoundTrip(t *testing.T) {
+	genReq := GenericRequest{
+		Model: "gemini-2.5-flash",
+		Messages: mustMessages(t, `[
+			{"role":"user","content":"北京天气如何"},
+			{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}]},
+			{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":"晴 25 度"}]},
+			{"role":"assistant","content":"北京今天晴，25 度。"}
+		]`),
+	}
+	gReq, _ := buildGoogleRequest(genReq, "test-scope", "")
+	exported := googleContentsToAnthropic(gReq.Contents)
+
+	if len(exported) != len(genReq.Messages) {
+		t.Fatalf("导出 %d 条消息，期望 %d: %+v", len(exported), len(genReq.Messages), exported)
+	}
+	wantRoles := []string{"user", "assistant", "user", "assistant"}
+	for i, m := range exported {
+		if m["role"] != wantRoles[i] {
+			t.Errorf("第 %d 条角色 = %v，期望 %s", i, m["role"], wantRoles[i])
+		}
+	}
+
+	blocksOf := func(i int) []map[string]any {
+		t.Helper()
+		blocks, ok := exported[i]["content"].([]map[string]any)
+		if !ok || len(blocks) == 0 {
+			t.Fatalf("第 %d 条消息缺少内容块: %+v", i, exported[i])
+		}
+		return blocks
+	}
+
+	if got := blocksOf(0)[0]; got["type"] != "text" || got["text"] != "北京天气如何" {
+		t.Errorf("首条 user 文本没有还原: %+v", got)
+	}
+
+	toolUse := blocksOf(1)[0]
+	if toolUse["type"] != "tool_use" || toolUse["name"] != "get_weather" {
+		t.Fatalf("tool_use 块没有还原: %+v", toolUse)
+	}
+	toolResult := blocksOf(2)[0]
+	if toolResult["type"] != "tool_result" {
+		t.Fatalf("tool_result 块没有还原: %+v", toolResult)
+	}
+	if toolResult["tool_use_id"] != toolUse["id"] {
+		t.Errorf("tool_result 应与同名 tool_use 配对: %v != %v", toolResult["tool_use_id"], toolUse["id"])
+	}
+	if toolResult["content"] != "晴 25 度" {
+		t.Errorf("tool_result 内容应还原为原始字符串，得到 %v", toolResult["content"])
+	}
+
+	if got := blocksOf(3)[0]; got["type"] != "text" || got["text"] != "北京今天晴，25 度。" {
+		t.Errorf("收尾 assistant 文本没有还原: %+v", got)
+	}
+}
+
+// 结构化 JSON 工具结果在导出时还原为 JSON 文本而不是 map 字符串化
+func TestAnthropicExportStructuredToolResult(t *testing.T) {
+	contents := []GoogleContent{
+		{Role: "model", Parts: []GooglePart{{
+			FunctionCall: &geminiFunctionCall{Name: "list_files", Args: map[string]any{"path": "/tmp"}},
+		}}},
+		{Role: "user", Parts: []GooglePart{{
+			FunctionResponse: &geminiFunctionResponse{
+				Name:     "list_files",
+				Response: map[string]any{"count": float64(2), "ok": true},
+			},
+		}}},
+	}
+	exported := googleContentsToAnthropic(contents)
+	if len(exported) != 2 {
+		t.Fatalf("期望 2 条消息: %+v", exported)
+	}
+	blocks := exported[1]["content"].([]map[string]any)
+	raw, ok := blocks[0]["content"].(string)
+	if !ok {
+		t.Fatalf("结构化结果应导出为 JSON 文本: %+v", blocks[0])
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		t.Fatalf("导出内容不是合法 JSON: %v", err)
+	}
+	if parsed["count"] != float64(2) || parsed["ok"] != true {
+		t.Errorf("结构化类型没有保留: %v", parsed)
+	}
+}
+
+// --- 响应转换：多段思考与多签名 (buildMiniMaxResponse) ---
+
+// Gemini 一次回复可能带多段 thought 和多个各自签名的 functionCall，
+// 每段思考各成一块、每个调用带自己的签名，不能只留最后一份
+func TestBuildMiniMaxResponseMultiThoughtMultiSignature(t *testing.T) {
+	var gResp GoogleResponse
+	fixture := `{
+		"candidates": [{
+			"content": {"role": "model", "parts": [
+				{"text": "先查北京", "thought": true, "thoughtSignature": "sig-thought-1"},
+				{"text": "再查上海", "thought": true, "thoughtSignature": "sig-thought-2"},
+				{"text": "我来并行查询两地天气。"},
+				{"functionCall": {"name": "get_weather", "args": {"city": "北京"}}, "thoughtSignature": "sig-call-1"},
+				{"functionCall": {"name": "get_weather", "args": {"city": "上海"}}, "thoughtSignature": "sig-call-2"}
+			]},
+			"finishReason": "STOP"
+		}],
+		"usageMetadata": {"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15}
+	}`
+	if err := json.Unmarshal([]byte(fixture), &gResp); err != nil {
+		t.Fatalf("fixture 解析失败: %v", err)
+	}
+
+	res, blockedErr := buildMiniMaxResponse(GenericRequest{Model: "gemini-2.5-flash"}, gResp, "test-scope", "")
+	if blockedErr != "" {
+		t.Fatalf("意外的拦截错误: %s", blockedErr)
+	}
+	content := res["content"].([]interface{})
+	if len(content) != 5 {
+		t.Fatalf("期望 5 个内容块 (2 thinking + 1 text + 2 tool_use)，得到 %d: %+v", len(content), content)
+	}
+
+	wantThinking := []struct{ text, sig string }{
+		{"先查北京", "sig-thought-1"},
+		{"再查上海", "sig-thought-2"},
+	}
+	for i, want := range wantThinking {
+		block := content[i].(map[string]interface{})
+		if block["type"] != "thinking" || block["thinking"] != want.text || block["signature"] != want.sig {
+			t.Errorf("thinking 块 %d = %+v，期望 %+v", i, block, want)
+		}
+	}
+	if block := content[2].(map[string]interface{}); block["type"] != "text" || block["text"] != "我来并行查询两地天气。" {
+		t.Errorf("text 块 = %+v", block)
+	}
+	wantSigs := []string{"sig-call-1", "sig-call-2"}
+	for i, sig := range wantSigs {
+		block := content[3+i].(map[string]interface{})
+		if block["type"] != "tool_use" || block["signature"] != sig {
+			t.Errorf("tool_use 块 %d 应带自己的签名 %s: %+v", i, sig, block)
+		}
+	}
+	if res["stop_reason"] != "tool_use" {
+		t.Errorf("stop_reason = %v，期望 tool_use", res["stop_reason"])
+	}
+}
+
+// --- 状态日志的撕裂恢复 (loadStateDir) ---
+
+// resetStateDir 把状态持久化的全局量指向一个干净目录
+func resetStateDir(t *testing.T, dir string) {
+	t.Helper()
+	stateJournalMu.Lock()
+	if stateJournal != nil {
+		stateJournal.Close()
+		stateJournal = nil
+	}
+	stateJournalSize = 0
+	stateJournalMu.Unlock()
+	stateDir = dir
+	fileIndex = make(map[string]FileIndexEntry)
+	t.Cleanup(func() {
+		stateJournalMu.Lock()
+		if stateJournal != nil {
+			stateJournal.Close()
+			stateJournal = nil
+		}
+		stateJournalSize = 0
+		stateJournalMu.Unlock()
+		stateDir = ""
+		fileIndex = make(map[string]FileIndexEntry)
+	})
+}
+
+// 在任意字节处截断日志（模拟掉电撕裂），重放必须恢复完整前缀并干净截断坏尾
+func TestStateJournalTornTailRecovery(t *testing.T) {
+	dir := t.TempDir()
+	resetStateDir(t, dir)
+
+	const records = 5
+	for i := 0; i < records; i++ {
+		data, _ := json.Marshal(FileIndexEntry{Name: fmt.Sprintf("files/f%d", i), MimeType: "image/png"})
+		appendStateRecord(stateRecord{Type: "file_put", Key: fmt.Sprintf("hash%d", i), Data: data})
+	}
+	full, err := os.ReadFile(stateJournalPath())
+	if err != nil {
+		t.Fatalf("读取日志失败: %v", err)
+	}
+	recLen := len(full) / records
+	if len(full)%records != 0 {
+		t.Fatalf("fixture 记录长度不齐: %d 字节 / %d 条", len(full), records)
+	}
+
+	// 覆盖头部中间、payload 中间、恰好整条边界等各种截断点
+	cuts := []int{3, recLen / 2, recLen, recLen + 7, 2*recLen + 1, 3 * recLen, len(full) - 1}
+	for _, cut := range cuts {
+		sub := t.TempDir()
+		resetStateDir(t, sub)
+		if err := os.WriteFile(stateJournalPath(), full[:cut], 0644); err != nil {
+			t.Fatalf("写截断日志失败: %v", err)
+		}
+		loadStateDir()
+
+		wantEntries := cut / recLen
+		if len(fileIndex) != wantEntries {
+			t.Errorf("截断于 %d 字节: 恢复 %d 条索引，期望 %d", cut, len(fileIndex), wantEntries)
+		}
+		for i := 0; i < wantEntries; i++ {
+			if _, ok := fileIndex[fmt.Sprintf("hash%d", i)]; !ok {
+				t.Errorf("截断于 %d 字节: 缺少 hash%d", cut, i)
+			}
+		}
+		// 坏尾应被截掉，下次启动不再反复警告
+		after, _ := os.ReadFile(stateJournalPath())
+		if len(after) != wantEntries*recLen {
+			t.Errorf("截断于 %d 字节: 日志应截到 %d 字节，实际 %d", cut, wantEntries*recLen, len(after))
+		}
+	}
+}
+
+// CRC 不匹配（位翻转）同样按撕裂处理，损坏记录之后的内容不再重放
+func TestStateJournalCRCMismatch(t *testing.T) {
+	dir := t.TempDir()
+	resetStateDir(t, dir)
+
+	for i := 0; i < 3; i++ {
+		data, _ := json.Marshal(FileIndexEntry{Name: fmt.Sprintf("files/f%d", i)})
+		appendStateRecord(stateRecord{Type: "file_put", Key: fmt.Sprintf("hash%d", i), Data: data})
+	}
+	full, _ := os.ReadFile(stateJournalPath())
+	recLen := len(full) / 3
+
+	sub := t.TempDir()
+	resetStateDir(t, sub)
+	corrupted := append([]byte(nil), full...)
+	corrupted[recLen+12] ^= 0xFF // 第二条记录的 payload 里翻一位
+	if err := os.WriteFile(stateJournalPath(), corrupted, 0644); err != nil {
+		t.Fatalf("写损坏日志失败: %v", err)
+	}
+	loadStateDir()
+
+	if len(fileIndex) != 1 {
+		t.Errorf("恢复 %d 条索引，期望只有损坏前的 1 条", len(fileIndex))
+	}
+	after, _ := os.ReadFile(stateJournalPath())
+	if len(after) != recLen {
+		t.Errorf("日志应截到第一条完整记录 (%d 字节)，实际 %d", recLen, len(after))
+	}
+}
+
+// --- 思考预算退避 (effectiveThinkingBudget) ---
+
+// 模拟连续 RESOURCE_EXHAUSTED：预算按重试路径的守卫条件逐次减半，
+// 到地板值停下；降档值按会话记忆，后续请求直接沿用且不会被抬高
+func TestThinkingBudgetDowngradeSequence(t *testing.T) {
+	const scope = "budget-test-scope"
+	t.Cleanup(func() {
+		thinkingBudgetsMu.Lock()
+		delete(thinkingBudgets, scope)
+		thinkingBudgetsMu.Unlock()
+	})
+
+	const requested = 8192
+	budget := effectiveThinkingBudget(scope, requested)
+	if budget != requested {
+		t.Fatalf("无记忆时应沿用请求预算 %d，得到 %d", requested, budget)
+	}
+
+	// 与 handleProxy 的重试守卫一致：>= 2*floor 才继续减半
+	var downgrades []int
+	for budget >= thinkingBudgetFloor*2 {
+		budget /= 2
+		thinkingBudgetsMu.Lock()
+		thinkingBudgets[scope] = budget
+		thinkingBudgetsMu.Unlock()
+		downgrades = append(downgrades, budget)
+	}
+	want := []int{4096, 2048, 1024, 512}
+	if len(downgrades) != len(want) {
+		t.Fatalf("降档序列 = %v，期望 %v", downgrades, want)
+	}
+	for i := range want {
+		if downgrades[i] != want[i] {
+			t.Fatalf("降档序列 = %v，期望 %v", downgrades, want)
+		}
+	}
+	if budget != thinkingBudgetFloor {
+		t.Errorf("最终预算 = %d，期望停在地板值 %d", budget, thinkingBudgetFloor)
+	}
+
+	// 同一会话的后续请求直接拿到降档值，不再先撞一遍限额
+	if got := effectiveThinkingBudget(scope, requested); got != thinkingBudgetFloor {
+		t.Errorf("降档后请求 %d 应沿用 %d，得到 %d", requested, thinkingBudgetFloor, got)
+	}
+	// 客户端主动要的更小预算不受记忆影响
+	if got := effectiveThinkingBudget(scope, 256); got != 256 {
+		t.Errorf("请求预算 256 低于记忆值时应沿用请求值，得到 %d", got)
+	}
+	// 其它会话不受影响
+	if got := effectiveThinkingBudget("other-scope", requested); got != requested {
+		t.Errorf("其它会话应不受降档影响，得到 %d", got)
+	}
+}
+
+// --- 空参数 schema 归一化 (processToolDeclaration / isEmptySchema) ---
+
+func TestEmptySchemaNormalization(t *testing.T) {
+	cases := []struct {
+		name      string
+		params    string // "" 表示 nil
+		wantEmpty bool
+	}{
+		{"nil", "", true},
+		{"null", "null", true},
+		{"empty-object", "{}", true},
+		{"bare-type", `{"type":"object"}`, true},
+		{"with-properties", `{"type":"object","properties":{"city":{"type":"string"}}}`, false},
+		{"empty-properties", `{"type":"object","properties":{}}`, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var params json.RawMessage
+			if tc.params != "" {
+				params = json.RawMessage(tc.params)
+			}
+			if got := isEmptySchema(params); got != tc.wantEmpty {
+				t.Errorf("isEmptySchema(%s) = %v，期望 %v", tc.params, got, tc.wantEmpty)
+			}
+			decl := processToolDeclaration("probe", "", params)
+			if tc.wantEmpty && decl.Parameters != nil {
+				t.Errorf("空 schema 应整体省略 parameters 字段，得到 %s", decl.Parameters)
+			}
+			if !tc.wantEmpty && decl.Parameters == nil {
+				t.Errorf("非空 schema 不应被丢弃: %s", tc.params)
+			}
+		})
+	}
+}
+
+// --- 上游内容拦截 (BLOCKLIST / PROHIBITED_CONTENT) ---
+
+// blockedFixture 按 finishReason 造一个带部分文本的候选响应
+func blockedFixture(t *testing.T, reason string) GoogleResponse {
+	t.Helper()
+	var gResp GoogleResponse
+	fixture := fmt.Sprintf(`{
+		"candidates": [{
+			"content": {"role": "model", "parts": [{"text": "已生成的部分回答"}]},
+			"finishReason": %q
+		}],
+		"usageMetadata": {"promptTokenCount": 10, "candidatesTokenCount": 3, "totalTokenCount": 13}
+	}`, reason)
+	if err := json.Unmarshal([]byte(fixture), &gResp); err != nil {
+		t.Fatalf("fixture 解析失败: %v", err)
+	}
+	return gResp
+}
+
+func TestBlockedFinishReasons(t *testing.T) {
+	for _, reason := range []string{"BLOCKLIST", "PROHIBITED_CONTENT"} {
+		t.Run(reason+"/error", func(t *testing.T) {
+			blockedResponse = "error"
+			blockedFinishMu.Lock()
+			before := blockedFinishStats[reason]
+			blockedFinishMu.Unlock()
+
+			res, blockedErr := buildMiniMaxResponse(GenericRequest{Model: "gemini-2.5-flash"}, blockedFixture(t, reason), "test-scope", "")
+			if blockedErr != reason {
+				t.Errorf("blockedErr = %q，期望 %q", blockedErr, reason)
+			}
+			if res != nil {
+				t.Errorf("error 模式不应返回响应体: %+v", res)
+			}
+
+			blockedFinishMu.Lock()
+			after := blockedFinishStats[reason]
+			blockedFinishMu.Unlock()
+			if after != before+1 {
+				t.Errorf("拦截计数未增加: %d → %d", before, after)
+			}
+		})
+		t.Run(reason+"/notice", func(t *testing.T) {
+			blockedResponse = "notice"
+			t.Cleanup(func() { blockedResponse = "error" })
+
+			res, blockedErr := buildMiniMaxResponse(GenericRequest{Model: "gemini-2.5-flash"}, blockedFixture(t, reason), "test-scope", "")
+			if blockedErr != "" {
+				t.Fatalf("notice 模式不应返回拦截错误: %q", blockedErr)
+			}
+			content := res["content"].([]interface{})
+			if len(content) != 2 {
+				t.Fatalf("期望部分文本 + 标注两个块，得到 %d: %+v", len(content), content)
+			}
+			if block := content[0].(map[string]interface{}); block["text"] != "已生成的部分回答" {
+				t.Errorf("部分文本丢失: %+v", block)
+			}
+			notice := content[1].(map[string]interface{})
+			text, _ := notice["text"].(string)
+			if !strings.Contains(text, reason) {
+				t.Errorf("标注块应点名拦截原因 %s: %+v", reason, notice)
+			}
+		})
+	}
+}
+
+// --- 节流队列 (waitThrottle) ---
+
+// 五个并发请求在节流生效期间排队，必须按票号一次放行一个。
+// 测试用回拨 throttleLastReq 模拟放行间隔到期，不真等 61 秒
+func TestThrottleQueueReleaseOrder(t *testing.T) {
+	throttleMu.Lock()
+	throttleUntil = time.Now().Add(30 * time.Second)
+	throttleLastReq = time.Now()
+	throttleHead, throttleTail = 0, 0
+	throttleMu.Unlock()
+	t.Cleanup(func() {
+		throttleMu.Lock()
+		throttleUntil = time.Time{}
+		throttleLastReq = time.Time{}
+		throttleHead, throttleTail = 0, 0
+		throttleMu.Unlock()
+	})
+
+	const waiters = 5
+	type release struct {
+		waiter   int
+		position int
+	}
+	done := make(chan release, waiters)
+
+	// 逐个入队，确保票号与编号一致（并发拿票的先后本身是不确定的）
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			done <- release{waiter: i, position: waitThrottle(context.Background())}
+		}(i)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			throttleMu.Lock()
+			tail := throttleTail
+			throttleMu.Unlock()
+			if tail == int64(i+1) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("第 %d 个请求没有入队", i)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// 每回拨一次放行间隔，应恰好多放行一个请求，且按入队顺序
+	for i := 0; i < waiters; i++ {
+		throttleMu.Lock()
+		throttleLastReq = time.Now().Add(-62 * time.Second)
+		throttleMu.Unlock()
+
+		select {
+		case r := <-done:
+			if r.waiter != i {
+				t.Fatalf("放行顺序错乱: 第 %d 次放行的是请求 %d", i, r.waiter)
+			}
+			if r.position != i+1 {
+				t.Errorf("请求 %d 的队列位置 = %d，期望 %d", r.waiter, r.position, i+1)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("第 %d 次放行超时", i)
+		}
+
+		// 确认间隔内没有第二个请求溜出来
+		select {
+		case r := <-done:
+			t.Fatalf("一个间隔放行了多个请求: %+v", r)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// --- 混合 assistant 消息与非标准角色 ---
+
+// 同一条 assistant 消息带 thinking/text/tool_use 块外加 OpenAI 式 tool_calls：
+// 排序应为 thinking → text → functionCall，content 块里出现过的 ID 不重复计入
+func TestMixedAssistantMessageOrdering(t *testing.T) {
+	msgs := mustMessages(t, `[
+		{"role":"user","content":"查一下天气"},
+		{"role":"assistant",
+		 "content":[
+			{"type":"text","text":"我来查询。"},
+			{"type":"thinking","thinking":"先调工具"},
+			{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}
+		 ],
+		 "tool_calls":[
+			{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"北京\"}"}},
+			{"id":"call_2","type":"function","function":{"name":"get_time","arguments":"{}"}}
+		 ]}
+	]`)
+	gReq, _ := buildGoogleRequest(GenericRequest{Model: "gemini-2.5-flash", Messages: msgs}, "test-scope", "")
+	if len(gReq.Contents) != 2 {
+		t.Fatalf("期望 2 条 contents，得到 %+v", gReq.Contents)
+	}
+	parts := gReq.Contents[1].Parts
+	if len(parts) != 4 {
+		t.Fatalf("期望 4 个 part (thinking/text/2 functionCall)，得到 %d: %+v", len(parts), parts)
+	}
+	if !parts[0].Thought || parts[0].Text != "先调工具" {
+		t.Errorf("thinking 应排最前: %+v", parts[0])
+	}
+	if parts[1].Thought || parts[1].Text != "我来查询。" {
+		t.Errorf("text 应居中: %+v", parts[1])
+	}
+	if parts[2].FunctionCall == nil || parts[2].FunctionCall.Name != "get_weather" {
+		t.Errorf("functionCall 应收尾且 call_1 不重复: %+v", parts[2])
+	}
+	if parts[3].FunctionCall == nil || parts[3].FunctionCall.Name != "get_time" {
+		t.Errorf("tool_calls 里新增的 call_2 应保留: %+v", parts[3])
+	}
+}
+
+// developer 并入 systemInstruction，tool 和 function 同义、都转 functionResponse
+func TestRoleMixTranscript(t *testing.T) {
+	msgs := mustMessages(t, `[
+		{"role":"developer","content":"只回答天气问题"},
+		{"role":"user","content":"北京天气如何"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}]},
+		{"role":"tool","tool_call_id":"call_1","name":"get_weather","content":"晴"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"call_2","name":"get_weather","input":{"city":"上海"}}]},
+		{"role":"function","tool_call_id":"call_2","name":"get_weather","content":"多云"}
+	]`)
+	gReq, _ := buildGoogleRequest(GenericRequest{Model: "gemini-2.5-flash", Messages: msgs}, "test-scope", "")
+	if gReq.SystemInstruction == nil || len(gReq.SystemInstruction.Parts) != 1 {
+		t.Fatalf("developer 应并入 systemInstruction: %+v", gReq.SystemInstruction)
+	}
+	if len(gReq.Contents) != 5 {
+		t.Fatalf("期望 5 条 contents，得到 %d: %+v", len(gReq.Contents), gReq.Contents)
+	}
+	for _, idx := range []int{2, 4} {
+		c := gReq.Contents[idx]
+		if c.Role != "user" || c.Parts[0].FunctionResponse == nil || c.Parts[0].FunctionResponse.Name != "get_weather" {
+			t.Errorf("第 %d 条应是 functionResponse user 消息: %+v", idx, c)
+		}
+	}
+}
+
+// --- 收尾 assistant 预填 (trailingPrefill) ---
+
+func TestTrailingPrefill(t *testing.T) {
+	cases := []struct {
+		name string
+		msgs string
+		want string
+	}{
+		{
+			"prefill-after-tool-use-history",
+			`[
+				{"role":"user","content":"北京天气如何"},
+				{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":"晴 25 度"}]},
+				{"role":"assistant","content":"北京今天"}
+			]`,
+			"北京今天",
+		},
+		{
+			"thinking-blocks-not-visible-text",
+			`[
+				{"role":"user","content":"ping"},
+				{"role":"assistant","content":[{"type":"thinking","thinking":"想一想"},{"type":"text","text":"答案是"}]}
+			]`,
+			"答案是",
+		},
+		{
+			"trailing-tool-use-is-not-prefill",
+			`[
+				{"role":"user","content":"北京天气如何"},
+				{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}]}
+			]`,
+			"",
+		},
+		{
+			"trailing-user",
+			`[{"role":"user","content":"ping"}]`,
+			"",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			genReq := GenericRequest{Model: "gemini-2.5-flash", Messages: mustMessages(t, tc.msgs)}
+			if got := trailingPrefill(genReq); got != tc.want {
+				t.Errorf("trailingPrefill = %q，期望 %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// Gemini 没回显预填时拼回去；回显了就不能重复拼接
+func TestBuildMiniMaxResponsePrefill(t *testing.T) {
+	makeResp := func(text string) GoogleResponse {
+		var gResp GoogleResponse
+		fixture := fmt.Sprintf(`{
+			"candidates": [{"content": {"role": "model", "parts": [{"text": %q}]}, "finishReason": "STOP"}],
+			"usageMetadata": {"promptTokenCount": 5, "candidatesTokenCount": 3, "totalTokenCount": 8}
+		}`, text)
+		if err := json.Unmarshal([]byte(fixture), &gResp); err != nil {
+			t.Fatalf("fixture 解析失败: %v", err)
+		}
+		return gResp
+	}
+	textOf := func(res map[string]interface{}) string {
+		for _, b := range res["content"].([]interface{}) {
+			block := b.(map[string]interface{})
+			if block["type"] == "text" {
+				return block["text"].(string)
+			}
+		}
+		return ""
+	}
+
+	res, _ := buildMiniMaxResponse(GenericRequest{Model: "gemini-2.5-flash"}, makeResp("晴，25 度。"), "test-scope", "北京今天")
+	if got := textOf(res); got != "北京今天晴，25 度。" {
+		t.Errorf("未回显预填时应拼回: %q", got)
+	}
+	res, _ = buildMiniMaxResponse(GenericRequest{Model: "gemini-2.5-flash"}, makeResp("北京今天晴，25 度。"), "test-scope", "北京今天")
+	if got := textOf(res); got != "北京今天晴，25 度。" {
+		t.Errorf("已回显预填时不应重复拼接: %q", got)
+	}
+}
+
+// --- 恢复函数名对回声明工具 (matchDeclaredToolName) ---
+
+func TestMatchDeclaredToolName(t *testing.T) {
+	tools := mustTools(t, `[
+		{"name":"bash:ls","description":"列目录","input_schema":{"type":"object","properties":{}}},
+		{"type":"function","function":{"name":"browser-navigate","parameters":{"type":"object","properties":{}}}}
+	]`)
+	cases := []struct{ in, want string }{
+		{"bash_ls", "bash:ls"},                   // 冒号被粗暴换成下划线后折叠匹配
+		{"browser_navigate", "browser-navigate"}, // 连字符同理
+		{"bash:ls", "bash:ls"},                   // 精确命中直接返回
+		{"unknown_tool", "unknown_tool"},         // 没有匹配时退回原值
+	}
+	for _, tc := range cases {
+		if got := matchDeclaredToolName(tc.in, tools); got != tc.want {
+			t.Errorf("matchDeclaredToolName(%q) = %q，期望 %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// --- 坏 JSON 修复 (fixJSON) ---
+
+// 来自真实坏工具参数的样本：裸 key、单引号、尾逗号、以及各种不能误伤的写法
+func TestFixJSONMalformedSamples(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want map[string]any
+	}{
+		{
+			"bare-keys",
+			`{path: "/tmp/a.txt", recursive: true}`,
+			map[string]any{"path": "/tmp/a.txt", "recursive": true},
+		},
+		{
+			"single-quoted",
+			`{'path': '/tmp/a.txt'}`,
+			map[string]any{"path": "/tmp/a.txt"},
+		},
+		{
+			"trailing-comma-object",
+			`{"a": 1,}`,
+			map[string]any{"a": float64(1)},
+		},
+		{
+			"trailing-comma-nested-array",
+			`{"cmd": ["ls", "-la",], "cwd": "/tmp",}`,
+			map[string]any{"cmd": []any{"ls", "-la"}, "cwd": "/tmp"},
+		},
+		{
+			"escaped-single-quote",
+			`{'msg': 'it\'s done'}`,
+			map[string]any{"msg": "it's done"},
+		},
+		{
+			"double-quote-inside-single",
+			`{'msg': 'say "hi"'}`,
+			map[string]any{"msg": `say "hi"`},
+		},
+		{
+			"mixed-everything",
+			`{query: 'select * from t', limit: 10, dry_run: false,}`,
+			map[string]any{"query": "select * from t", "limit": float64(10), "dry_run": false},
+		},
+		{
+			"valid-json-untouched",
+			`{"text": "带逗号, 和 {花括号} 的内容", "n": 1}`,
+			map[string]any{"text": "带逗号, 和 {花括号} 的内容", "n": float64(1)},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fixed := fixJSON(tc.in)
+			var got map[string]any
+			if err := json.Unmarshal([]byte(fixed), &got); err != nil {
+				t.Fatalf("修复结果仍不是合法 JSON: %v\n输入: %s\n输出: %s", err, tc.in, fixed)
+			}
+			wantJSON, _ := json.Marshal(tc.want)
+			gotJSON, _ := json.Marshal(got)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("解析结果 = %s，期望 %s (输入 %s)", gotJSON, wantJSON, tc.in)
+			}
+		})
+	}
+}
+
+// MALFORMED_FUNCTION_CALL 的 finishMessage 走修复路径后应恢复出名字和参数
+func TestParseMalformedFunctionCallWithBadJSON(t *testing.T) {
+	msg := "Malformed function call: call:bash:run({cmd: 'ls -la', cwd: '/tmp',})"
+	name, args := parseMalformedFunctionCall(msg)
+	if name != "bash_run" {
+		t.Errorf("恢复的函数名 = %q，期望 bash_run", name)
+	}
+	if args["cmd"] != "ls -la" || args["cwd"] != "/tmp" {
+		t.Errorf("恢复的参数 = %v", args)
+	}
+}
+
+// --- tool_result 块数组 (文本拼接 + 图片保留) ---
+
+func TestToolResultArrayOfBlocks(t *testing.T) {
+	msgs := mustMessages(t, `[
+		{"role":"user","content":"截个图"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"screenshot","input":{}}]},
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":[
+			{"type":"text","text":"已截图"},
+			{"type":"text","text":"分辨率 1920x1080"},
+			{"type":"image","source":{"type":"base64","media_type":"image/png","data":"aGk="}}
+		]}]}
+	]`)
+	gReq, _ := buildGoogleRequest(GenericRequest{Model: "gemini-2.5-flash", Messages: msgs}, "test-scope", "")
+	parts := gReq.Contents[2].Parts
+	if len(parts) != 2 {
+		t.Fatalf("期望 functionResponse + 图片两个 part，得到 %d: %+v", len(parts), parts)
+	}
+	fr := parts[0].FunctionResponse
+	if fr == nil || fr.Name != "screenshot" {
+		t.Fatalf("第一个 part 应是 functionResponse: %+v", parts[0])
+	}
+	if got := fr.Response["result"]; got != "已截图\n分辨率 1920x1080" {
+		t.Errorf("文本块应换行拼接进 result，得到 %v", got)
+	}
+	img := parts[1].InlineData
+	if img == nil || img.MimeType != "image/png" || img.Data != "aGk=" {
+		t.Errorf("图片块应跟在 functionResponse 后保留: %+v", parts[1])
+	}
+}
+
+// --- WebSocket 并发帧 (集成) ---
+
+// 用 memubot-ws-client.go 的客户端在同一条连接上并发打 10 个请求帧，
+// 验证每帧都拿到自己 id 对应的完整响应
+func TestWSConcurrentFrames(t *testing.T) {
+	stub := &conformanceStub{}
+	upLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("桩上游监听失败: %v", err)
+	}
+	defer upLn.Close()
+	upMux := http.NewServeMux()
+	upMux.HandleFunc("/", stub.handler)
+	go http.Serve(upLn, upMux)
+	oldBase := googleAPIBase
+	googleAPIBase = "http://" + upLn.Addr().String()
+	defer func() { googleAPIBase = oldBase }()
+
+	wsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("WS 监听失败: %v", err)
+	}
+	defer wsLn.Close()
+	wsMux := http.NewServeMux()
+	wsMux.HandleFunc("/v1/ws", handleWS)
+	go http.Serve(wsLn, wsMux)
+
+	c, err := dialWSClient(wsLn.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("WS 握手失败: %v", err)
+	}
+	defer c.close()
+
+	const frames = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, frames)
+	for i := 0; i < frames; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("frame-%d", i)
+			body := fmt.Sprintf(`{"model":%q,"messages":[{"role":"user","content":"ping %d"}]}`, fixtureChatModel, i)
+			reply, err := c.call(id, []byte(body), 30*time.Second)
+			if err != nil {
+				errs <- fmt.Errorf("%s: %v", id, err)
+				return
+			}
+			if reply.Id != id || reply.Status != 200 || reply.Error != "" {
+				errs <- fmt.Errorf("%s: 响应异常 id=%s status=%d error=%q", id, reply.Id, reply.Status, reply.Error)
+				return
+			}
+			if !strings.Contains(string(reply.Response), "pong") {
+				errs <- fmt.Errorf("%s: 响应缺少正文: %s", id, reply.Response)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if calls, _, _ := stub.counts(); calls < frames {
+		t.Errorf("桩上游只收到 %d 次调用，期望至少 %d", calls, frames)
+	}
+}
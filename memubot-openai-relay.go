@@ -3,28 +3,89 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"container/list"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
+	"math/big"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // --- 全局变量与标志 ---
 var (
-	debugMode bool
-	proxyURL  string
-	tpmFlag   string // 原始命令行输入，如 "0.9M" 或 "5000,000"
-	apiKey    string // OpenAI-Compatible API Key (通过请求头传入)
-	baseURL   string // 完整的 API 端点 URL (如 https://api.siliconflow.cn/v1/chat/completions)
+	debugMode          bool
+	rawErrors          bool          // --raw-errors: 上游错误原样透传，不包 base_resp 封套
+	upstreamTimeout    time.Duration // --timeout: 上游请求超时
+	tlsCert            string        // --tls-cert: 证书文件，与 --tls-key 同时指定时启用 HTTPS
+	tlsKey             string        // --tls-key: 私钥文件
+	tlsSelfSigned      bool          // --tls-self-signed: 启动时生成临时自签名证书
+	maxOutput          int           // --max-output: 输出 token 上限，0 表示不设置
+	outputFormat       string        // --output-format: minimax (默认，带 base_resp 封套) 或 anthropic
+	printConfig        string
+	corsOrigin         string
+	conformanceURL     string
+	conformanceOffline bool
+	maxBody            int64
+	mergeRoles         bool
+	systemRole         string
+	maxHistory         int
+	summarizeHistory   bool
+	logFilePath        string
+	logBodies          bool
+	logMaxSize         int
+	logKeep            int
+	pickMode           string
+	logLevel           string
+	logFormat          string
+	verboseUsage       bool
+	priceIn            float64
+	priceOut           float64
+	redactContent      bool
+	pricingFile        string
+	convUsageTTL       time.Duration
+	queueDepth         int
+	maxConcurrent      int
+	queueTimeout       time.Duration
+	relayToken         string
+	dryRun             bool
+	proxyURL           string
+	tpmFlag            string // 原始命令行输入，如 "0.9M" 或 "5000,000"
+	apiKey             string // OpenAI-Compatible API Key (通过请求头传入)
+	baseURL            string // 完整的 API 端点 URL (如 https://api.siliconflow.cn/v1/chat/completions)
 )
 
 // --- TPM 速率限制 ---
@@ -123,6 +184,31 @@ type ContentBlock struct {
 	ToolUseId string          `json:"tool_use_id,omitempty"`
 	Content   json.RawMessage `json:"content,omitempty"`
 	IsError   bool            `json:"is_error,omitempty"`
+	// 图片字段 (image / input_image / image_url)
+	Source   *ImageSource `json:"source,omitempty"`    // Anthropic 风格
+	ImageURL *ImageURL    `json:"image_url,omitempty"` // OpenAI 风格
+	// Anthropic 提示缓存标记
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+// CacheControl Anthropic 风格的缓存标记 {"type":"ephemeral"}
+// OpenAI 兼容端点不认这个字段，解析后剥离（转换时本就不会带出去），
+// 只在调试时打点，方便确认客户端的缓存标记到达了哪些消息。
+type CacheControl struct {
+	Type string `json:"type,omitempty"`
+}
+
+// ImageSource Anthropic 风格的图片来源 (base64 或 url)
+type ImageSource struct {
+	Type      string `json:"type,omitempty"` // base64 / url
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// ImageURL OpenAI 风格的图片引用
+type ImageURL struct {
+	URL string `json:"url"`
 }
 
 type ToolCall struct {
@@ -134,88 +220,2363 @@ type ToolCall struct {
 	} `json:"function"`
 }
 
-type GenericMessage struct {
-	Role       string          `json:"role"`
-	Content    json.RawMessage `json:"content"`
-	ToolCalls  []ToolCall      `json:"tool_calls,omitempty"`
-	ToolCallID string          `json:"tool_call_id,omitempty"`
-	Name       string          `json:"name,omitempty"`
+type GenericMessage struct {
+	Role       string          `json:"role"`
+	Content    json.RawMessage `json:"content"`
+	ToolCalls  []ToolCall      `json:"tool_calls,omitempty"`
+	ToolCallID string          `json:"tool_call_id,omitempty"`
+	Name       string          `json:"name,omitempty"`
+}
+
+type GenericTool struct {
+	// OpenAI 风格
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+	// Anthropic/MiniMax 风格 (顶层字段)
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+}
+
+type GenericRequest struct {
+	Model          string           `json:"model"`
+	System         json.RawMessage  `json:"system,omitempty"` // 字符串或 text 块数组
+	Messages       []GenericMessage `json:"messages"`
+	Tools          []GenericTool    `json:"tools,omitempty"`
+	Temperature    *float64         `json:"temperature,omitempty"`
+	Stream         bool             `json:"stream,omitempty"`
+	Betas          []string         `json:"betas,omitempty"`           // Anthropic 的 beta 特性标志
+	N              int              `json:"n,omitempty"`               // 多候选数量，透传为 OpenAI n
+	ResponseFormat json.RawMessage  `json:"response_format,omitempty"` // JSON 模式/结构化输出，原样透传
+}
+
+// --- OpenAI API Request/Response Structs ---
+
+type OpenAIMessage struct {
+	Role       string           `json:"role"`
+	Content    interface{}      `json:"content,omitempty"` // string or null
+	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+	Name       string           `json:"name,omitempty"`
+}
+
+type OpenAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type OpenAIToolDef struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type OpenAIRequest struct {
+	Model          string          `json:"model"`
+	Messages       []OpenAIMessage `json:"messages"`
+	Tools          []OpenAIToolDef `json:"tools,omitempty"`
+	Stream         bool            `json:"stream,omitempty"`
+	Temperature    *float64        `json:"temperature,omitempty"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	N              int             `json:"n,omitempty"`
+	ResponseFormat json.RawMessage `json:"response_format,omitempty"`
+}
+
+type OpenAIResponse struct {
+	ID      string `json:"id"`
+	Choices []struct {
+		Message struct {
+			Role             string           `json:"role"`
+			Content          *string          `json:"content"`
+			ReasoningContent *string          `json:"reasoning_content,omitempty"`
+			ToolCalls        []OpenAIToolCall `json:"tool_calls,omitempty"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// --- WebSocket 多路复用端点 (实验性) ---
+// memU 每个请求都新开 TCP 连接，在部分环境（Windows + 激进的杀毒软件）
+// 每回合多付 200-400ms。/v1/ws 在一条连接上复用多个请求：客户端发
+// {"id":"自选标识","request":{GenericRequest}} 文本帧，转发器对每帧走与
+// HTTP 路径完全相同的处理（含限流扣减），回 {"id":...,"status":...,
+// "response":...} 帧。RFC 6455 的最小实现：仅文本/二进制单帧，无扩展。
+// HTTP 路径仍是默认且完整支持的方式。
+
+const wsMagicGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+const wsMaxFrameSize = 16 << 20 // 16 MB
+
+// memResponseWriter 内存中的 ResponseWriter，用于把帧请求喂给 handleProxy
+type memResponseWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func newMemResponseWriter() *memResponseWriter {
+	return &memResponseWriter{header: make(http.Header), status: 200}
+}
+
+func (m *memResponseWriter) Header() http.Header         { return m.header }
+func (m *memResponseWriter) WriteHeader(status int)      { m.status = status }
+func (m *memResponseWriter) Write(b []byte) (int, error) { return m.buf.Write(b) }
+
+// wsReadFrame 读取一个客户端帧（必须带掩码），返回 opcode 和去掩码后的载荷
+func wsReadFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("不支持分片帧")
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext))
+	}
+	if length > wsMaxFrameSize {
+		return 0, nil, fmt.Errorf("帧过大: %d 字节", length)
+	}
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+// wsWriteFrame 写出一个服务端帧（不带掩码）
+func wsWriteFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	n := len(payload)
+	switch {
+	case n < 126:
+		header = append(header, byte(n))
+	case n < 1<<16:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127)
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(n))
+		header = append(header, ext...)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// handleWS 处理 /v1/ws 的升级与帧循环
+func handleWS(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "Expected WebSocket upgrade", 400)
+		return
+	}
+	wsKey := r.Header.Get("Sec-WebSocket-Key")
+	if wsKey == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", 400)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket unsupported", 500)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(wsKey + wsMagicGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	rw.Flush()
+	slog.Info(fmt.Sprintf("[WS] 连接建立: %s", r.RemoteAddr))
+
+	var writeMu sync.Mutex
+	writeFrame := func(opcode byte, payload []byte) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		wsWriteFrame(rw, opcode, payload)
+		rw.Flush()
+	}
+
+	for {
+		opcode, payload, err := wsReadFrame(rw.Reader)
+		if err != nil {
+			slog.Info(fmt.Sprintf("[WS] 连接结束: %v", err))
+			return
+		}
+		switch opcode {
+		case 0x8: // close
+			writeFrame(0x8, nil)
+			return
+		case 0x9: // ping
+			writeFrame(0xA, payload)
+		case 0x1, 0x2:
+			go serveWSFrame(r, writeFrame, payload)
+		}
+	}
+}
+
+// serveWSFrame 处理单个请求帧：喂给 handleProxy 并把结果打包回帧
+func serveWSFrame(upgradeReq *http.Request, writeFrame func(byte, []byte), payload []byte) {
+	var frame struct {
+		Id      string          `json:"id"`
+		Request json.RawMessage `json:"request"`
+	}
+	if err := json.Unmarshal(payload, &frame); err != nil || len(frame.Request) == 0 {
+		out, _ := json.Marshal(map[string]interface{}{"id": frame.Id, "error": "帧格式错误，需要 {id, request}"})
+		writeFrame(0x1, out)
+		return
+	}
+
+	// 走与 HTTP 路径完全相同的处理（含限流扣减）
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(frame.Request))
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range []string{"Authorization", "x-api-key", "X-Conversation-Id", "X-Session-Id"} {
+		if v := upgradeReq.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	mw := newMemResponseWriter()
+	handleProxy(mw, req)
+
+	var response interface{}
+	if json.Unmarshal(mw.buf.Bytes(), &response) != nil {
+		response = mw.buf.String()
+	}
+	out, _ := json.Marshal(map[string]interface{}{
+		"id":       frame.Id,
+		"status":   mw.status,
+		"response": response,
+	})
+	writeFrame(0x1, out)
+}
+
+// --- 代理支持 ---
+// buildProxyTransport 根据 --proxy/--proxy-auth 构造 Transport。
+// http/https 代理走标准 ProxyURL（URL 里的 user:pass 会自动生成
+// Proxy-Authorization）；socks5:// 用内置的最小实现（CONNECT +
+// 无认证/用户名密码认证），避免引入 golang.org/x/net 依赖。
+
+var proxyAuth string // --proxy-auth "user:pass"，优先于 URL 里的 userinfo
+
+func buildProxyTransport() *http.Transport {
+	transport := &http.Transport{}
+	if proxyURL == "" {
+		return transport
+	}
+	pURL, err := url.Parse(proxyURL)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("代理地址无法解析: %v", err))
+		return transport
+	}
+	if proxyAuth != "" {
+		user, pass, _ := strings.Cut(proxyAuth, ":")
+		pURL.User = url.UserPassword(user, pass)
+	}
+	if pURL.Scheme == "socks5" {
+		transport.DialContext = socks5DialContext(pURL)
+		return transport
+	}
+	transport.Proxy = http.ProxyURL(pURL)
+	return transport
+}
+
+// socks5DialContext 返回经由 SOCKS5 代理的拨号函数 (RFC 1928/1929)
+func socks5DialContext(pURL *url.URL) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", pURL.Host)
+		if err != nil {
+			return nil, err
+		}
+		if err := socks5Handshake(conn, pURL, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// socks5Handshake 完成方法协商、可选的用户名密码认证和 CONNECT
+func socks5Handshake(conn net.Conn, pURL *url.URL, addr string) error {
+	var user, pass string
+	if pURL.User != nil {
+		user = pURL.User.Username()
+		pass, _ = pURL.User.Password()
+	}
+
+	// 方法协商
+	if user != "" {
+		conn.Write([]byte{0x05, 0x02, 0x00, 0x02})
+	} else {
+		conn.Write([]byte{0x05, 0x01, 0x00})
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return err
+	}
+	switch method[1] {
+	case 0x00:
+		// 无需认证
+	case 0x02:
+		// 用户名密码认证 (RFC 1929)
+		buf := []byte{0x01, byte(len(user))}
+		buf = append(buf, user...)
+		buf = append(buf, byte(len(pass)))
+		buf = append(buf, pass...)
+		conn.Write(buf)
+		authResp := make([]byte, 2)
+		if _, err := io.ReadFull(conn, authResp); err != nil {
+			return err
+		}
+		if authResp[1] != 0x00 {
+			return fmt.Errorf("SOCKS5 认证失败")
+		}
+	default:
+		return fmt.Errorf("SOCKS5 代理不接受可用的认证方式 (0x%02x)", method[1])
+	}
+
+	// CONNECT
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, 0x01)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	} else {
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	conn.Write(req)
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 CONNECT 失败 (0x%02x)", reply[1])
+	}
+	// 读掉绑定地址，保持流对齐
+	switch reply[3] {
+	case 0x01:
+		_, err = io.ReadFull(conn, make([]byte, 4+2))
+	case 0x03:
+		lenByte := make([]byte, 1)
+		if _, err = io.ReadFull(conn, lenByte); err == nil {
+			_, err = io.ReadFull(conn, make([]byte, int(lenByte[0])+2))
+		}
+	case 0x04:
+		_, err = io.ReadFull(conn, make([]byte, 16+2))
+	}
+	return err
+}
+
+// --- 工具可见性探测 ---
+// 有的 OpenAI 兼容网关收下 100 个工具定义却只把前 64 个传给模型，
+// 后面的工具永远不会被调用，用户还以为是 memU 的问题。--verify-tools
+// 开启后，每套不同的工具集（按哈希）只花一次探测请求：让模型列出它
+// 能看到的工具名，和实际发送的清单比对，缺了就大声告警。
+
+var (
+	verifyTools        bool                    // --verify-tools
+	verifiedToolSets   = make(map[string]bool) // 工具集哈希 -> 已探测
+	verifiedToolSetsMu sync.Mutex
+)
+
+// verifyToolSet 对一套工具做一次性可见性探测（异步调用）
+func verifyToolSet(reqKey, model string, tools []OpenAIToolDef) {
+	raw, _ := json.Marshal(tools)
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:])[:16]
+
+	verifiedToolSetsMu.Lock()
+	if verifiedToolSets[hash] {
+		verifiedToolSetsMu.Unlock()
+		return
+	}
+	// 先登记，探测失败也不反复烧请求
+	verifiedToolSets[hash] = true
+	verifiedToolSetsMu.Unlock()
+
+	probe := OpenAIRequest{
+		Model: model,
+		Messages: []OpenAIMessage{{
+			Role:    "user",
+			Content: "List the names of every tool/function available to you, one per line. Output only the names, nothing else.",
+		}},
+		Tools: tools,
+	}
+	payload, _ := json.Marshal(probe)
+
+	transport := buildProxyTransport()
+	client := &http.Client{Transport: transport, Timeout: upstreamTimeout}
+
+	httpReq, _ := http.NewRequest("POST", upstreamURLFor(model), bytes.NewBuffer(payload))
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+reqKey)
+	applyExtraHeaders(httpReq.Header)
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		slog.Info(fmt.Sprintf("[TOOL] 工具可见性探测失败: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		slog.Info(fmt.Sprintf("[TOOL] 工具可见性探测失败 (状态码 %d)", resp.StatusCode))
+		return
+	}
+
+	var oaiResp OpenAIResponse
+	if err := json.Unmarshal(body, &oaiResp); err != nil || len(oaiResp.Choices) == 0 {
+		slog.Info("[TOOL] 工具可见性探测响应无法解析")
+		return
+	}
+	seen := ""
+	if oaiResp.Choices[0].Message.Content != nil {
+		seen = *oaiResp.Choices[0].Message.Content
+	}
+
+	var missing []string
+	for _, t := range tools {
+		if !strings.Contains(seen, t.Function.Name) {
+			missing = append(missing, t.Function.Name)
+		}
+	}
+	if len(missing) > 0 {
+		slog.Info(fmt.Sprintf("[TOOL] ⚠️ 上游可能截断了工具列表！声明 %d 个，模型看不到这些: %s", len(tools), strings.Join(missing, ", ")))
+	} else if debugMode {
+		slog.Info(fmt.Sprintf("[TOOL] 工具可见性探测通过: %d 个工具全部可见 (哈希 %s)", len(tools), hash))
+	}
+}
+
+// --- SSE 流式响应拼装 ---
+// 客户端要求流式时，上游返回 SSE。转发器的输出始终是非流式的完整响应，
+// 所以在服务端把分片拼装回等价的非流式 JSON。上游在 [DONE] 之前断开
+// （EOF 截断）不算错误：能拼多少算多少，由调用方标记截断的 stop_reason。
+
+// assembleSSEResponse 把 SSE 响应体拼装为非流式响应 JSON。
+// 第二个返回值表示流在收到 [DONE]/finish_reason 之前被截断。
+func assembleSSEResponse(body []byte) ([]byte, bool) {
+	type deltaToolCall struct {
+		Index    int    `json:"index"`
+		ID       string `json:"id"`
+		Type     string `json:"type"`
+		Function struct {
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		} `json:"function"`
+	}
+	type chunk struct {
+		ID      string `json:"id"`
+		Choices []struct {
+			Delta struct {
+				Content          string          `json:"content"`
+				ReasoningContent string          `json:"reasoning_content"`
+				ToolCalls        []deltaToolCall `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+
+	var contentBuf, reasoningBuf strings.Builder
+	toolCallAcc := make(map[int]*OpenAIToolCall)
+	var toolCallOrder []int
+	var id, finish string
+	usage := map[string]interface{}{}
+	sawDone := false
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			sawDone = true
+			break
+		}
+		var c chunk
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			// 半截 JSON，多半是截断点，跳过
+			continue
+		}
+		if c.ID != "" {
+			id = c.ID
+		}
+		if c.Usage != nil {
+			usage["prompt_tokens"] = c.Usage.PromptTokens
+			usage["completion_tokens"] = c.Usage.CompletionTokens
+			usage["total_tokens"] = c.Usage.TotalTokens
+		}
+		if len(c.Choices) == 0 {
+			continue
+		}
+		ch := c.Choices[0]
+		contentBuf.WriteString(ch.Delta.Content)
+		reasoningBuf.WriteString(ch.Delta.ReasoningContent)
+		for _, tc := range ch.Delta.ToolCalls {
+			acc, ok := toolCallAcc[tc.Index]
+			if !ok {
+				acc = &OpenAIToolCall{ID: tc.ID, Type: tc.Type}
+				toolCallAcc[tc.Index] = acc
+				toolCallOrder = append(toolCallOrder, tc.Index)
+			}
+			if tc.ID != "" {
+				acc.ID = tc.ID
+			}
+			if tc.Function.Name != "" {
+				acc.Function.Name = tc.Function.Name
+			}
+			acc.Function.Arguments += tc.Function.Arguments
+		}
+		if ch.FinishReason != "" {
+			finish = ch.FinishReason
+		}
+	}
+
+	truncated := !sawDone && finish == ""
+
+	message := map[string]interface{}{"role": "assistant", "content": contentBuf.String()}
+	if reasoningBuf.Len() > 0 {
+		message["reasoning_content"] = reasoningBuf.String()
+	}
+	if len(toolCallOrder) > 0 {
+		calls := make([]*OpenAIToolCall, 0, len(toolCallOrder))
+		for _, idx := range toolCallOrder {
+			calls = append(calls, toolCallAcc[idx])
+		}
+		message["tool_calls"] = calls
+	}
+	// 尽力而为的用量估算：上游没报 usage 时按字节粗估补上
+	if len(usage) == 0 {
+		usage["completion_tokens"] = (contentBuf.Len() + reasoningBuf.Len()) / 3
+	}
+
+	assembled, _ := json.Marshal(map[string]interface{}{
+		"id": id,
+		"choices": []map[string]interface{}{{
+			"message":       message,
+			"finish_reason": finish,
+		}},
+		"usage": usage,
+	})
+	return assembled, truncated
+}
+
+// --- 按模型路由上游端点 ---
+// 部分供应商把聊天模型和推理模型拆在不同端点上。--model-url 可重复指定
+// "模型名=完整端点 URL"，命中映射的模型改发对应端点，其余仍走 --url。
+
+type multiFlag []string
+
+func (m *multiFlag) String() string { return strings.Join(*m, ", ") }
+func (m *multiFlag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
+
+var (
+	modelURLFlags multiFlag
+	modelURLs     = make(map[string]string) // 模型名 -> 端点 URL
+)
+
+// upstreamURLFor 返回该模型应使用的上游端点
+func upstreamURLFor(model string) string {
+	if u, ok := modelURLs[model]; ok {
+		return u
+	}
+	return baseURL
+}
+
+// --- 虚拟密钥 ---
+// 一个转发器服务多个 memU 机器人：每个机器人把自己的 vk_ 虚拟密钥当作
+// API Key 配置，转发器鉴别身份、套用该机器人的限额和统计桶，转发前替换
+// 成真实上游密钥。配置了虚拟密钥后，未登记的 vk_ 密钥一律 401。
+
+type virtualKey struct {
+	Bot     string
+	Limiter *TokenBucketLimiter // nil 表示不单独限流
+}
+
+var (
+	virtualKeyFlags  multiFlag
+	clientKeyFlags   multiFlag
+	extraHeaderFlags multiFlag
+	extraHeaders     [][2]string
+	clientKeys       = map[string]string{}
+	virtualKeys      = make(map[string]*virtualKey) // 密钥 -> 身份
+	vkStatsMu        sync.Mutex
+	vkStats          = make(map[string]int) // 机器人名 -> 请求数
+)
+
+// parseVirtualKeys 解析 --virtual-key "机器人名:密钥[:tpm=0.3M]" 配置
+func parseVirtualKeys() {
+	for _, spec := range virtualKeyFlags {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("virtual-key 参数错误: %q (格式应为 机器人名:密钥[:tpm=0.3M])", spec)
+		}
+		vk := &virtualKey{Bot: parts[0]}
+		for _, opt := range parts[2:] {
+			k, v, _ := strings.Cut(opt, "=")
+			switch k {
+			case "tpm":
+				val, err := parseTPM(v)
+				if err != nil {
+					log.Fatalf("virtual-key %s 的 tpm 参数错误: %v", parts[0], err)
+				}
+				vk.Limiter = NewTokenBucketLimiter(val)
+			default:
+				log.Fatalf("virtual-key 参数错误: 未知选项 %q", opt)
+			}
+		}
+		virtualKeys[parts[1]] = vk
+	}
+	if len(virtualKeys) > 0 && apiKey == "" {
+		log.Fatalf("使用 --virtual-key 时必须用 --key 提供真实上游密钥")
+	}
+}
+
+// parseClientKeys 解析 --client-keys 的 "客户端密钥[=上游密钥]" 规格
+func parseClientKeys() {
+	for _, spec := range clientKeyFlags {
+		ck, up, _ := strings.Cut(spec, "=")
+		if ck == "" {
+			log.Fatalf("client-keys 参数错误: %q (格式应为 客户端密钥[=上游密钥])", spec)
+		}
+		clientKeys[ck] = up
+	}
+	if len(clientKeys) > 0 {
+		fmt.Printf("[✓] --client-keys 已启用，%d 个允许的入站密钥\n", len(clientKeys))
+	}
+}
+
+// parseExtraHeaders 解析 --header 的 "Key: Value" 规格
+func parseExtraHeaders() {
+	for _, spec := range extraHeaderFlags {
+		k, v, ok := strings.Cut(spec, ":")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			log.Fatalf("header 参数错误: %q (格式应为 \"Key: Value\")", spec)
+		}
+		extraHeaders = append(extraHeaders, [2]string{k, v})
+	}
+	if len(extraHeaders) > 0 {
+		fmt.Printf("[✓] --header 已启用，转发时附加 %d 个额外请求头\n", len(extraHeaders))
+	}
+}
+
+// applyExtraHeaders 把 --header 配置的额外请求头附加到上游请求，
+// OpenRouter / Azure 这类要求 HTTP-Referer、组织头的后端不用再改代码
+func applyExtraHeaders(h http.Header) {
+	for _, kv := range extraHeaders {
+		h.Set(kv[0], kv[1])
+	}
+}
+
+// --- anthropic-beta 标志 ---
+// memU（以及其他 Anthropic 系客户端）会用 anthropic-beta 请求头或 betas 字段
+// 申请 beta 特性。维护一份已知标志清单，拼写错误能立刻在日志里看出来。
+var knownBetas = map[string]bool{
+	"prompt-caching-2024-07-31":        true,
+	"max-tokens-3-5-sonnet-2024-07-15": true,
+	"output-128k-2025-02-19":           true,
+	"computer-use-2024-10-22":          true,
+	"computer-use-2025-01-24":          true,
+	"token-efficient-tools-2025-02-19": true,
+	"interleaved-thinking-2025-05-14":  true,
+	"extended-cache-ttl-2025-04-11":    true,
+	"context-1m-2025-08-07":            true,
+}
+
+// collectBetas 合并请求头与 body 中申请的 beta 标志并去重，未知标志打警告
+func collectBetas(r *http.Request, bodyBetas []string) []string {
+	var betas []string
+	seen := map[string]bool{}
+	add := func(b string) {
+		b = strings.TrimSpace(b)
+		if b == "" || seen[b] {
+			return
+		}
+		seen[b] = true
+		if !knownBetas[b] {
+			slog.Warn(fmt.Sprintf("未知的 anthropic-beta 标志: %q (拼写错误？)", b))
+		}
+		betas = append(betas, b)
+	}
+	for _, b := range strings.Split(r.Header.Get("anthropic-beta"), ",") {
+		add(b)
+	}
+	for _, b := range bodyBetas {
+		add(b)
+	}
+	return betas
+}
+
+// corsMiddleware 给所有响应加 CORS 头并处理 OPTIONS 预检
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", corsOrigin)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key, anthropic-beta, X-Conversation-Id, X-Session-Id")
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(204)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rootHandler 返回对外服务的 handler。未设置 --cors-origin 时返回 nil，
+// 即沿用 DefaultServeMux 的原有行为
+func rootHandler() http.Handler {
+	if corsOrigin == "" {
+		return nil
+	}
+	fmt.Printf("[✓] --cors-origin %s\n", corsOrigin)
+	return corsMiddleware(http.DefaultServeMux)
+}
+
+// readRequestBody 读取请求体，按 Content-Encoding 解压 gzip / deflate
+func readRequestBody(r *http.Request) ([]byte, error) {
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return raw, nil
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("gzip 解压失败: %w", err)
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case "deflate":
+		// RFC 上 deflate 指 zlib 封装，但也有客户端发裸 deflate 流，两种都试
+		if zr, err := zlib.NewReader(bytes.NewReader(raw)); err == nil {
+			defer zr.Close()
+			return io.ReadAll(zr)
+		}
+		fr := flate.NewReader(bytes.NewReader(raw))
+		defer fr.Close()
+		data, err := io.ReadAll(fr)
+		if err != nil {
+			return nil, fmt.Errorf("deflate 解压失败: %w", err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("不支持的 Content-Encoding: %q", r.Header.Get("Content-Encoding"))
+	}
+}
+
+// --- 一致性检查 (--conformance / --conformance-offline) ---
+// 对一个正在运行的转发器跑一组脚本化检查：模型列表、错误形状、格式往返
+// (Anthropic 内容块、tool_result 两种变体)、stream 封装、限流头和缓存命中。
+// 需要确定性上游的检查（tool_calls、429、缓存命中）只在 --conformance-offline
+// 下执行：该模式在本进程内起一个桩上游替身和转发器监听，CI 可直接使用；
+// 在线模式下这些检查报 SKIP。每项检查单独报 PASS/FAIL，最后以退出码收尾。
+
+// 一致性检查用的黄金请求样例（单元测试与 --conformance 共用）
+const (
+	fixtureChatModel       = "deepseek-ai/DeepSeek-V3"
+	fixtureAnthropicBlocks = `{"model":"deepseek-ai/DeepSeek-V3","messages":[{"role":"user","content":[{"type":"text","text":"ping"}]}]}`
+	fixtureToolCall        = `{"model":"deepseek-ai/DeepSeek-V3","messages":[{"role":"user","content":"北京天气如何"}],"tools":[{"name":"get_weather","description":"查询城市天气","input_schema":{"type":"object","properties":{"city":{"type":"string"}}}}]}`
+	fixtureToolResultStr   = `{"model":"deepseek-ai/DeepSeek-V3","messages":[{"role":"user","content":"北京天气如何"},{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}]},{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":"晴 25 度"}]}]}`
+	fixtureToolResultArr   = `{"model":"deepseek-ai/DeepSeek-V3","messages":[{"role":"user","content":"北京天气如何"},{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}]},{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":[{"type":"text","text":"晴 25 度"}]}]}]}`
+	fixtureStreamChat      = `{"model":"deepseek-ai/DeepSeek-V3","stream":true,"messages":[{"role":"user","content":"ping"}]}`
+	fixtureCacheableChat   = `{"model":"deepseek-ai/DeepSeek-V3","temperature":0,"messages":[{"role":"user","content":"cache ping"}]}`
+)
+
+// conformanceCheck 单项检查：名字 + 执行函数，失败时返回描述
+type conformanceCheck struct {
+	Name    string
+	Offline bool // 需要确定性上游，只在 --conformance-offline 下执行
+	Run     func(base string, client *http.Client) error
+}
+
+// conformanceStub 进程内的桩上游：记录调用次数，按请求内容返回
+// 固定的文本或 tool_calls 响应，充当付费上游的确定性替身
+type conformanceStub struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (cs *conformanceStub) count() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.calls
+}
+
+func (cs *conformanceStub) handler(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	cs.mu.Lock()
+	cs.calls++
+	cs.mu.Unlock()
+	if r.Method == "GET" {
+		writeJSON(w, 200, map[string]interface{}{
+			"data": []map[string]interface{}{{"id": fixtureChatModel, "object": "model"}},
+		})
+		return
+	}
+	// 带工具且还没有工具结果 → 返回 tool_calls，模拟模型决定调用工具
+	if bytes.Contains(body, []byte(`"tools"`)) && !bytes.Contains(body, []byte(`"role":"tool"`)) {
+		writeJSON(w, 200, map[string]interface{}{
+			"id": "chatcmpl-stub",
+			"choices": []map[string]interface{}{{
+				"message": map[string]interface{}{
+					"role": "assistant",
+					"tool_calls": []map[string]interface{}{{
+						"id":   "call_stub_1",
+						"type": "function",
+						"function": map[string]interface{}{
+							"name":      "get_weather",
+							"arguments": `{"city":"北京"}`,
+						},
+					}},
+				},
+				"finish_reason": "tool_calls",
+			}},
+			"usage": map[string]interface{}{"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15},
+		})
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"id": "chatcmpl-stub",
+		"choices": []map[string]interface{}{{
+			"message":       map[string]interface{}{"role": "assistant", "content": "pong"},
+			"finish_reason": "stop",
+		}},
+		"usage": map[string]interface{}{"prompt_tokens": 10, "completion_tokens": 2, "total_tokens": 12},
+	})
+}
+
+// startConformanceStub 起桩上游并让本进程的转发器监听随机端口，返回转发器地址
+func startConformanceStub() (string, *conformanceStub) {
+	stub := &conformanceStub{}
+	upLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("conformance-offline 桩上游监听失败: %v", err)
+	}
+	upMux := http.NewServeMux()
+	upMux.HandleFunc("/", stub.handler)
+	go http.Serve(upLn, upMux)
+	baseURL = "http://" + upLn.Addr().String() + "/v1/chat/completions"
+	if apiKey == "" {
+		apiKey = "sk-conformance-stub"
+	}
+
+	relayLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("conformance-offline 转发器监听失败: %v", err)
+	}
+	relayMux := http.NewServeMux()
+	relayMux.HandleFunc("/v1/", handleProxy)
+	relayMux.HandleFunc("/stats", handleStats)
+	go http.Serve(relayLn, relayMux)
+	fmt.Printf("[✓] --conformance-offline 桩上游 %s\n", upLn.Addr())
+	return "http://" + relayLn.Addr().String(), stub
+}
+
+func runConformance(base string) {
+	var stub *conformanceStub
+	if conformanceOffline {
+		base, stub = startConformanceStub()
+	}
+	base = strings.TrimSuffix(base, "/")
+	client := &http.Client{Timeout: 60 * time.Second}
+	authHeader := func(req *http.Request) {
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+	}
+	postJSON := func(path, body string) (*http.Response, []byte, error) {
+		req, _ := http.NewRequest("POST", base+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		authHeader(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, data, nil
+	}
+	// 解析聊天响应（minimax/anthropic 形状），校验 assistant 角色和 content 数组
+	parseChat := func(data []byte) (string, []ContentBlock, error) {
+		var parsed struct {
+			Role       string         `json:"role"`
+			StopReason string         `json:"stop_reason"`
+			Content    []ContentBlock `json:"content"`
+		}
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			return "", nil, fmt.Errorf("响应不是合法 JSON: %v", err)
+		}
+		if parsed.Role != "assistant" || len(parsed.Content) == 0 {
+			return "", nil, fmt.Errorf("响应缺少 assistant 角色或 content 数组: %s", truncateForLog(data))
+		}
+		return parsed.StopReason, parsed.Content, nil
+	}
+
+	checks := []conformanceCheck{
+		{"models 端点", false, func(base string, client *http.Client) error {
+			req, _ := http.NewRequest("GET", base+"/v1/models", nil)
+			authHeader(req)
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			data, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != 200 {
+				return fmt.Errorf("HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			var parsed struct {
+				Data []json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(data, &parsed); err != nil {
+				return fmt.Errorf("响应不是合法 JSON: %v", err)
+			}
+			if len(parsed.Data) == 0 {
+				return fmt.Errorf("data 数组为空")
+			}
+			return nil
+		}},
+		{"非法 JSON 的错误形状", false, func(base string, client *http.Client) error {
+			resp, data, err := postJSON("/v1/chat/completions", "{")
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 400 {
+				return fmt.Errorf("期望 400，得到 HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			return nil
+		}},
+		{"未知路径返回 404", false, func(base string, client *http.Client) error {
+			resp, data, err := postJSON("/v1/nonexistent", "{}")
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 404 {
+				return fmt.Errorf("期望 404，得到 HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			return nil
+		}},
+		{"聊天往返的响应结构", false, func(base string, client *http.Client) error {
+			body := `{"model":"deepseek-ai/DeepSeek-V3","messages":[{"role":"user","content":"ping"}]}`
+			resp, data, err := postJSON("/v1/chat/completions", body)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 200 {
+				return fmt.Errorf("HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			_, _, perr := parseChat(data)
+			return perr
+		}},
+		{"Anthropic 内容块往返", false, func(base string, client *http.Client) error {
+			resp, data, err := postJSON("/v1/chat/completions", fixtureAnthropicBlocks)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 200 {
+				return fmt.Errorf("HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			_, blocks, perr := parseChat(data)
+			if perr != nil {
+				return perr
+			}
+			if blocks[0].Type != "text" && blocks[0].Type != "thinking" {
+				return fmt.Errorf("期望 text 内容块，得到 %q: %s", blocks[0].Type, truncateForLog(data))
+			}
+			return nil
+		}},
+		{"tool_result 往返 (字符串)", false, func(base string, client *http.Client) error {
+			resp, data, err := postJSON("/v1/chat/completions", fixtureToolResultStr)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 200 {
+				return fmt.Errorf("HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			_, _, perr := parseChat(data)
+			return perr
+		}},
+		{"tool_result 往返 (块数组)", false, func(base string, client *http.Client) error {
+			resp, data, err := postJSON("/v1/chat/completions", fixtureToolResultArr)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 200 {
+				return fmt.Errorf("HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			_, _, perr := parseChat(data)
+			return perr
+		}},
+		{"tool_calls 往返", true, func(base string, client *http.Client) error {
+			resp, data, err := postJSON("/v1/chat/completions", fixtureToolCall)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 200 {
+				return fmt.Errorf("HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			stop, blocks, perr := parseChat(data)
+			if perr != nil {
+				return perr
+			}
+			if stop != "tool_use" {
+				return fmt.Errorf("期望 stop_reason tool_use，得到 %q: %s", stop, truncateForLog(data))
+			}
+			for _, b := range blocks {
+				if b.Type == "tool_use" && b.Name == "get_weather" && len(b.Input) > 0 {
+					return nil
+				}
+			}
+			return fmt.Errorf("响应缺少 get_weather 的 tool_use 块: %s", truncateForLog(data))
+		}},
+		{"stream 请求返回完整 JSON", true, func(base string, client *http.Client) error {
+			resp, data, err := postJSON("/v1/chat/completions", fixtureStreamChat)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 200 {
+				return fmt.Errorf("HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			if bytes.HasPrefix(bytes.TrimSpace(data), []byte("data:")) {
+				return fmt.Errorf("响应是 SSE 帧而不是完整 JSON: %s", truncateForLog(data))
+			}
+			var obj map[string]interface{}
+			if err := json.Unmarshal(data, &obj); err != nil {
+				return fmt.Errorf("响应不是单个合法 JSON 对象: %v", err)
+			}
+			return nil
+		}},
+		{"限流 429 带 Retry-After", true, func(base string, client *http.Client) error {
+			saved := tpmLimiter
+			tpmLimiter = NewTokenBucketLimiter(1)
+			defer func() { tpmLimiter = saved }()
+			resp, data, err := postJSON("/v1/chat/completions", fixtureAnthropicBlocks)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 429 {
+				return fmt.Errorf("期望 429，得到 HTTP %d: %s", resp.StatusCode, truncateForLog(data))
+			}
+			if resp.Header.Get("Retry-After") == "" {
+				return fmt.Errorf("429 响应缺少 Retry-After 头")
+			}
+			return nil
+		}},
+		{"响应缓存命中 (两次相同请求)", true, func(base string, client *http.Client) error {
+			savedMode, savedCache := cacheMode, respCache
+			cacheMode = true
+			respCache = newResponseLRU(respCacheCapacity)
+			defer func() { cacheMode, respCache = savedMode, savedCache }()
+			before := stub.count()
+			_, first, err := postJSON("/v1/chat/completions", fixtureCacheableChat)
+			if err != nil {
+				return err
+			}
+			_, second, err := postJSON("/v1/chat/completions", fixtureCacheableChat)
+			if err != nil {
+				return err
+			}
+			if upstream := stub.count() - before; upstream != 1 {
+				return fmt.Errorf("期望只打一次上游，实际 %d 次", upstream)
+			}
+			// relay_meta 带耗时等易变字段，对比内容块而不是原始字节
+			_, c1, perr := parseChat(first)
+			if perr != nil {
+				return perr
+			}
+			_, c2, perr := parseChat(second)
+			if perr != nil {
+				return perr
+			}
+			if !reflect.DeepEqual(c1, c2) {
+				return fmt.Errorf("两次响应的内容不一致:\n第一次: %s\n第二次: %s", truncateForLog(first), truncateForLog(second))
+			}
+			return nil
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if c.Offline && !conformanceOffline {
+			fmt.Printf("[SKIP] %s (需 --conformance-offline)\n", c.Name)
+			continue
+		}
+		if err := c.Run(base, client); err != nil {
+			failed++
+			fmt.Printf("[FAIL] %s: %v\n", c.Name, err)
+		} else {
+			fmt.Printf("[PASS] %s\n", c.Name)
+		}
+	}
+	fmt.Printf("一致性检查完成: %d/%d 通过\n", len(checks)-failed, len(checks))
+	if failed > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// truncateForLog 报告里只留响应开头，免得一个 FAIL 刷一屏
+func truncateForLog(data []byte) string {
+	s := strings.TrimSpace(string(data))
+	if len(s) > 200 {
+		return s[:200] + "..."
+	}
+	return s
+}
+
+// systemText 把 system 字段还原为纯文本。Anthropic 客户端可能发字符串，
+// 也可能发 {"type":"text","text":...} 的块数组（常带 cache_control），
+// 两种编码拼出的文本一致，缓存键也因此保持稳定
+func systemText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var blocks []ContentBlock
+	if err := json.Unmarshal(raw, &blocks); err == nil {
+		var texts []string
+		for _, b := range blocks {
+			if b.Type == "text" && b.Text != "" {
+				texts = append(texts, b.Text)
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	slog.Warn("system 字段格式无法识别，已忽略")
+	return ""
+}
+
+// buildOpenAIFormatResponse 把 MiniMax 形状的响应换壳成 OpenAI chat.completion：
+// text 块拼成 content，thinking 块进 reasoning_content，tool_use 转
+// tool_calls（参数字符串化）
+func buildOpenAIFormatResponse(res map[string]interface{}) map[string]interface{} {
+	toInt := func(v interface{}) int {
+		switch n := v.(type) {
+		case int:
+			return n
+		case float64:
+			return int(n)
+		}
+		return 0
+	}
+	var textParts, thinkingParts []string
+	var toolCalls []map[string]interface{}
+	if blocks, ok := res["content"].([]interface{}); ok {
+		for _, b := range blocks {
+			blk, ok := b.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch blk["type"] {
+			case "text":
+				if t, ok := blk["text"].(string); ok {
+					textParts = append(textParts, t)
+				}
+			case "thinking":
+				if t, ok := blk["thinking"].(string); ok {
+					thinkingParts = append(thinkingParts, t)
+				}
+			case "tool_use":
+				args, _ := json.Marshal(blk["input"])
+				name, _ := blk["name"].(string)
+				id, _ := blk["id"].(string)
+				toolCalls = append(toolCalls, map[string]interface{}{
+					"id":   id,
+					"type": "function",
+					"function": map[string]interface{}{
+						"name":      name,
+						"arguments": string(args),
+					},
+				})
+			}
+		}
+	}
+	message := map[string]interface{}{
+		"role":    "assistant",
+		"content": strings.Join(textParts, ""),
+	}
+	if len(thinkingParts) > 0 {
+		message["reasoning_content"] = strings.Join(thinkingParts, "\n")
+	}
+	if len(toolCalls) > 0 {
+		message["tool_calls"] = toolCalls
+	}
+	finish := "stop"
+	switch res["stop_reason"] {
+	case "tool_use":
+		finish = "tool_calls"
+	case "max_tokens", "truncated":
+		finish = "length"
+	}
+	var promptTokens, completionTokens int
+	if u, ok := res["usage"].(map[string]interface{}); ok {
+		promptTokens = toInt(u["input_tokens"])
+		completionTokens = toInt(u["output_tokens"])
+	}
+	return map[string]interface{}{
+		"id":      fmt.Sprintf("chatcmpl-%v", res["id"]),
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   res["model"],
+		"choices": []interface{}{map[string]interface{}{
+			"index":         0,
+			"message":       message,
+			"finish_reason": finish,
+		}},
+		"usage": map[string]interface{}{
+			"prompt_tokens":     promptTokens,
+			"completion_tokens": completionTokens,
+			"total_tokens":      promptTokens + completionTokens,
+		},
+	}
+}
+
+// summarizeDroppedHistory 把被 --max-history 截掉的旧轮次压缩成一条摘要，
+// 通过一次廉价的上游调用完成。结果按被摘要的范围缓存，同一前缀不会每轮重算
+var (
+	summaryCacheMu sync.Mutex
+	summaryCache   = map[string]string{}
+)
+
+func summarizeDroppedHistory(dropped []OpenAIMessage, model, reqKey string) string {
+	raw, err := json.Marshal(dropped)
+	if err != nil {
+		return ""
+	}
+	cacheKey := fmt.Sprintf("%x", sha256.Sum256(raw))
+	summaryCacheMu.Lock()
+	cached, ok := summaryCache[cacheKey]
+	summaryCacheMu.Unlock()
+	if ok {
+		return cached
+	}
+	var sb strings.Builder
+	for _, m := range dropped {
+		if text, ok := m.Content.(string); ok && text != "" {
+			sb.WriteString(m.Role)
+			sb.WriteString(": ")
+			sb.WriteString(text)
+			sb.WriteString("\n")
+		}
+	}
+	if sb.Len() == 0 {
+		return ""
+	}
+	sumReq := OpenAIRequest{
+		Model: model,
+		Messages: []OpenAIMessage{{
+			Role:    "user",
+			Content: "请把下面的对话历史压缩成一段简明的摘要，保留关键事实、已做的决定和未完成的事项，不要添加评论：\n\n" + sb.String(),
+		}},
+		MaxTokens: 512,
+	}
+	payload, err := json.Marshal(sumReq)
+	if err != nil {
+		return ""
+	}
+	httpReq, _ := http.NewRequest("POST", upstreamURLFor(model), bytes.NewReader(payload))
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+reqKey)
+	applyExtraHeaders(httpReq.Header)
+	client := &http.Client{Transport: buildProxyTransport(), Timeout: 60 * time.Second}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("历史摘要调用失败: %v", err))
+		return ""
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		slog.Warn(fmt.Sprintf("历史摘要调用失败: HTTP %d", resp.StatusCode))
+		return ""
+	}
+	var oResp OpenAIResponse
+	if err := json.Unmarshal(body, &oResp); err != nil || len(oResp.Choices) == 0 || oResp.Choices[0].Message.Content == nil {
+		return ""
+	}
+	summary := strings.TrimSpace(*oResp.Choices[0].Message.Content)
+	if summary != "" {
+		summaryCacheMu.Lock()
+		summaryCache[cacheKey] = summary
+		summaryCacheMu.Unlock()
+	}
+	return summary
+}
+
+// --- 审计日志 (--log-file) ---
+// 每个请求追加一行 JSON，互斥串行化写入，并发 handleProxy 不会把行写花
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+	auditSize int64
+)
+
+// auditWrite 追加一行审计记录。超过 --log-max-size 时先轮转
+func auditWrite(entry map[string]interface{}) {
+	if logFilePath == "" {
+		return
+	}
+	entry["ts"] = time.Now().Format(time.RFC3339)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil && !openAuditFile() {
+		return
+	}
+	if auditSize+int64(len(line))+1 > int64(logMaxSize)*1024*1024 {
+		rotateAuditLog()
+		if auditFile == nil && !openAuditFile() {
+			return
+		}
+	}
+	n, _ := auditFile.Write(append(line, '\n'))
+	auditSize += int64(n)
+}
+
+func openAuditFile() bool {
+	f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error(fmt.Sprintf("打开审计日志失败: %v", err))
+		return false
+	}
+	auditFile = f
+	auditSize = 0
+	if st, err := f.Stat(); err == nil {
+		auditSize = st.Size()
+	}
+	return true
+}
+
+// rotateAuditLog 按大小轮转：log → log.1 → … → log.N，最多保留 --log-keep 份
+func rotateAuditLog() {
+	auditFile.Close()
+	auditFile = nil
+	os.Remove(fmt.Sprintf("%s.%d", logFilePath, logKeep))
+	for i := logKeep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", logFilePath, i), fmt.Sprintf("%s.%d", logFilePath, i+1))
+	}
+	os.Rename(logFilePath, logFilePath+".1")
+}
+
+// --verbose-usage 的会话累计（atomic，handleProxy 并发累加）
+var (
+	usageRequests     int64
+	usageInputTokens  int64
+	usageOutputTokens int64
+	usageCacheHits    int64
+	throttledMillis   int64 // 限流/节流等待的累计时长
+)
+
+// printUsageSummary --verbose-usage 的退出小结：总请求、token 与估算费用
+func printUsageSummary() {
+	in := atomic.LoadInt64(&usageInputTokens)
+	out := atomic.LoadInt64(&usageOutputTokens)
+	hits := atomic.LoadInt64(&usageCacheHits)
+	succ, fail, count429 := requestOutcomeCounts()
+	slog.Info(fmt.Sprintf("[EXIT] 会话用量: %d 次请求 (成功 %d / 失败 %d, 其中 429 %d 次), 输入 %d tokens, 输出 %d tokens, 缓存命中 %d 次",
+		succ+fail, succ, fail, count429, in, out, hits))
+	if t := atomic.LoadInt64(&throttledMillis); t > 0 {
+		slog.Info(fmt.Sprintf("[EXIT] 限流等待合计: %s", (time.Duration(t) * time.Millisecond).Round(time.Second)))
+	}
+	if respCache != nil {
+		respCache.mu.Lock()
+		slog.Info(fmt.Sprintf("[EXIT] 响应缓存: 命中 %d / 未命中 %d", respCache.hits, respCache.misses))
+		respCache.mu.Unlock()
+	}
+	perModel, total := costSnapshot()
+	if verboseUsage {
+		for name, c := range perModel {
+			slog.Info(fmt.Sprintf("[EXIT]   %s: 输入 %d (缓存 %d) / 输出 %d tokens, $%.4f", name, c.InputTokens, c.CachedTokens, c.OutputTokens, c.Cost))
+		}
+	}
+	if total > 0 {
+		slog.Info(fmt.Sprintf("[EXIT] 估算费用合计: $%.4f", total))
+	} else if priceIn > 0 || priceOut > 0 {
+		cost := float64(in)/1e6*priceIn + float64(out)/1e6*priceOut
+		slog.Info(fmt.Sprintf("[EXIT] 估算费用: $%.4f (按每 1M tokens 输入 $%.2f / 输出 $%.2f)", cost, priceIn, priceOut))
+	}
+}
+
+// --- 日志脱敏 ---
+
+var (
+	keyQueryRe = regexp.MustCompile(`(key=)[A-Za-z0-9_\-]{8,}`)
+	bearerRe   = regexp.MustCompile(`(Bearer )[A-Za-z0-9_\-.]{8,}`)
+)
+
+// maskKeys 无条件打码日志中出现的 API 密钥（URL 查询串、Authorization 回显）
+func maskKeys(s string) string {
+	s = keyQueryRe.ReplaceAllString(s, "${1}****")
+	s = bearerRe.ReplaceAllString(s, "${1}****")
+	if apiKey != "" {
+		s = strings.ReplaceAll(s, apiKey, redactSecret(apiKey))
+	}
+	return s
+}
+
+// debugDump 调试输出前的统一脱敏：密钥始终打码，--redact 时再抹掉消息正文
+func debugDump(raw []byte) string {
+	if redactContent {
+		raw = redactJSON(raw)
+	}
+	return maskKeys(string(raw))
+}
+
+// redactJSON 把消息正文/工具参数换成长度占位符，保留结构便于排查转换问题
+func redactJSON(raw []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return raw
+	}
+	out, err := json.Marshal(redactNode(v))
+	if err != nil {
+		return raw
+	}
+	return out
+}
+
+func redactNode(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for k, val := range n {
+			switch k {
+			case "input", "args", "arguments":
+				if obj, ok := val.(map[string]interface{}); ok {
+					n[k] = fmt.Sprintf("<object %d keys>", len(obj))
+					continue
+				}
+				fallthrough
+			case "text", "thinking", "data", "system", "content":
+				if s, ok := val.(string); ok {
+					n[k] = fmt.Sprintf("<%d chars>", len(s))
+					continue
+				}
+				n[k] = redactNode(val)
+			default:
+				n[k] = redactNode(val)
+			}
+		}
+		return n
+	case []interface{}:
+		for i := range n {
+			n[i] = redactNode(n[i])
+		}
+		return n
+	}
+	return v
+}
+
+// newRequestID 生成 8 位十六进制请求标识
+func newRequestID() string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// --- Prometheus /metrics（手写 exposition 格式，不引第三方依赖）---
+
+var (
+	metricsMu       sync.Mutex
+	metricsRequests = map[string]int64{} // "model|status" → 次数
+	metricsRetries  int64
+	latencyBuckets  = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	latencyCounts   = make([]int64, len(latencyBuckets))
+	latencySum      float64
+	latencyCount    int64
+)
+
+// recordRequestMetric 请求完成后记一笔（含延迟直方图）
+func recordRequestMetric(model string, status int, latency time.Duration) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsRequests[fmt.Sprintf("%s|%d", model, status)]++
+	sec := latency.Seconds()
+	latencySum += sec
+	latencyCount++
+	for i, b := range latencyBuckets {
+		if sec <= b {
+			latencyCounts[i]++
+		}
+	}
+}
+
+// requestOutcomeCounts 从 /stats 的请求计数器聚合成功/失败/429 次数
+func requestOutcomeCounts() (succ, fail, count429 int64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for k, v := range metricsRequests {
+		if strings.HasSuffix(k, "|200") {
+			succ += v
+		} else {
+			fail += v
+			if strings.HasSuffix(k, "|429") {
+				count429 += v
+			}
+		}
+	}
+	return
+}
+
+// handleMetrics 按 Prometheus 文本格式导出计数器/直方图/仪表
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var b strings.Builder
+	metricsMu.Lock()
+	b.WriteString("# TYPE relay_requests_total counter\n")
+	for k, v := range metricsRequests {
+		kv := strings.SplitN(k, "|", 2)
+		fmt.Fprintf(&b, "relay_requests_total{model=%q,status=%q} %d\n", kv[0], kv[1], v)
+	}
+	b.WriteString("# TYPE relay_request_duration_seconds histogram\n")
+	for i, bucket := range latencyBuckets {
+		fmt.Fprintf(&b, "relay_request_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bucket, 'g', -1, 64), latencyCounts[i])
+	}
+	fmt.Fprintf(&b, "relay_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", latencyCount)
+	fmt.Fprintf(&b, "relay_request_duration_seconds_sum %g\n", latencySum)
+	fmt.Fprintf(&b, "relay_request_duration_seconds_count %d\n", latencyCount)
+	metricsMu.Unlock()
+	b.WriteString("# TYPE relay_tokens_total counter\n")
+	fmt.Fprintf(&b, "relay_tokens_total{direction=\"input\"} %d\n", atomic.LoadInt64(&usageInputTokens))
+	fmt.Fprintf(&b, "relay_tokens_total{direction=\"output\"} %d\n", atomic.LoadInt64(&usageOutputTokens))
+	b.WriteString("# TYPE relay_cache_hits_total counter\n")
+	fmt.Fprintf(&b, "relay_cache_hits_total %d\n", atomic.LoadInt64(&usageCacheHits))
+	b.WriteString("# TYPE relay_retries_total counter\n")
+	fmt.Fprintf(&b, "relay_retries_total %d\n", atomic.LoadInt64(&metricsRetries))
+	if respCache != nil {
+		b.WriteString("# TYPE relay_response_cache_entries gauge\n")
+		respCache.mu.Lock()
+		fmt.Fprintf(&b, "relay_response_cache_entries %d\n", len(respCache.entries))
+		respCache.mu.Unlock()
+	}
+	w.Write([]byte(b.String()))
+}
+
+// --- 计费估算 (--pricing) ---
+// 内置常用模型单价（美元/1M tokens），--pricing 指向的 JSON 文件可覆盖或追加。
+// 未知模型退回 --price-in/--price-out 并告警一次
+
+type modelPricing struct {
+	In       float64 `json:"in"`
+	Out      float64 `json:"out"`
+	CachedIn float64 `json:"cached_in"`
+}
+
+var pricingTable = map[string]modelPricing{
+	"deepseek-ai/DeepSeek-V3": {In: 0.27, Out: 1.10},
+	"deepseek-ai/DeepSeek-R1": {In: 0.55, Out: 2.19},
+	"gpt-4o":                  {In: 2.50, Out: 10, CachedIn: 1.25},
+	"gpt-4o-mini":             {In: 0.15, Out: 0.60, CachedIn: 0.075},
+}
+
+type modelCost struct {
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	CachedTokens int64   `json:"cached_tokens"`
+	Cost         float64 `json:"estimated_cost_usd"`
+}
+
+var (
+	costMu      sync.Mutex
+	costByModel = map[string]*modelCost{}
+	costWarned  = map[string]bool{}
+)
+
+// lookupPricing 先精确匹配再前缀匹配（带日期后缀的模型名也能命中）
+func lookupPricing(model string) (modelPricing, bool) {
+	if p, ok := pricingTable[model]; ok {
+		return p, true
+	}
+	for name, p := range pricingTable {
+		if strings.HasPrefix(model, name) {
+			return p, true
+		}
+	}
+	return modelPricing{}, false
+}
+
+// recordCost 按用量累计该模型的估算费用
+func recordCost(model string, in, out, cachedIn int) {
+	p, known := lookupPricing(model)
+	costMu.Lock()
+	defer costMu.Unlock()
+	if !known {
+		p = modelPricing{In: priceIn, Out: priceOut}
+		if !costWarned[model] {
+			costWarned[model] = true
+			slog.Warn(fmt.Sprintf("未收录模型 %s 的单价，费用按 --price-in/--price-out 估算", model))
+		}
+	}
+	mc := costByModel[model]
+	if mc == nil {
+		mc = &modelCost{}
+		costByModel[model] = mc
+	}
+	mc.InputTokens += int64(in)
+	mc.OutputTokens += int64(out)
+	mc.CachedTokens += int64(cachedIn)
+	mc.Cost += float64(in-cachedIn)/1e6*p.In + float64(cachedIn)/1e6*p.CachedIn + float64(out)/1e6*p.Out
+	if debugMode {
+		total := 0.0
+		for _, c := range costByModel {
+			total += c.Cost
+		}
+		slog.Debug(fmt.Sprintf("累计估算费用: $%.4f", total))
+	}
+}
+
+// loadPricingFile 读取 --pricing 的 JSON 覆盖表 {"model": {"in":...,"out":...,"cached_in":...}}
+func loadPricingFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("读取 --pricing 文件失败: %v", err)
+	}
+	var override map[string]modelPricing
+	if err := json.Unmarshal(data, &override); err != nil {
+		log.Fatalf("解析 --pricing 文件失败: %v", err)
+	}
+	for name, p := range override {
+		pricingTable[name] = p
+	}
+	fmt.Printf("[✓] --pricing %s (覆盖 %d 个模型单价)\n", path, len(override))
+}
+
+// costSnapshot 复制当前各模型的累计用量与费用
+func costSnapshot() (map[string]modelCost, float64) {
+	costMu.Lock()
+	defer costMu.Unlock()
+	out := make(map[string]modelCost, len(costByModel))
+	total := 0.0
+	for name, c := range costByModel {
+		out[name] = *c
+		total += c.Cost
+	}
+	return out, total
+}
+
+// --- 按会话的用量统计（不依赖 --cache）---
+
+type convUsage struct {
+	Requests     int64     `json:"requests"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+	CachedTokens int64     `json:"cached_tokens"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+var (
+	convUsageMu  sync.Mutex
+	convUsageMap = map[string]*convUsage{}
+)
+
+// recordConvUsage 按会话键累计用量
+func recordConvUsage(scope string, in, out, cached int) {
+	convUsageMu.Lock()
+	defer convUsageMu.Unlock()
+	u := convUsageMap[scope]
+	if u == nil {
+		u = &convUsage{}
+		convUsageMap[scope] = u
+	}
+	u.Requests++
+	u.InputTokens += int64(in)
+	u.OutputTokens += int64(out)
+	u.CachedTokens += int64(cached)
+	u.LastSeen = time.Now()
+}
+
+// gcConvUsage 清掉空闲超过 --usage-ttl 的会话统计
+func gcConvUsage() {
+	if convUsageTTL <= 0 {
+		return
+	}
+	convUsageMu.Lock()
+	defer convUsageMu.Unlock()
+	for scope, u := range convUsageMap {
+		if time.Since(u.LastSeen) > convUsageTTL {
+			delete(convUsageMap, scope)
+		}
+	}
+}
+
+// handleUsageCSV GET /stats/usage.csv：按会话导出用量表
+func handleUsageCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	var b strings.Builder
+	b.WriteString("conversation,requests,input_tokens,output_tokens,cached_tokens,last_seen\n")
+	convUsageMu.Lock()
+	for scope, u := range convUsageMap {
+		fmt.Fprintf(&b, "%s,%d,%d,%d,%d,%s\n", scope, u.Requests, u.InputTokens, u.OutputTokens, u.CachedTokens, u.LastSeen.Format(time.RFC3339))
+	}
+	convUsageMu.Unlock()
+	w.Write([]byte(b.String()))
+}
+
+// usageScope 求用量统计的会话键：优先会话头，缺省退回 system 哈希
+func usageScope(r *http.Request, system string) string {
+	if id := r.Header.Get("X-Conversation-Id"); id != "" {
+		return id
+	}
+	if id := r.Header.Get("X-Session-Id"); id != "" {
+		return id
+	}
+	h := sha256.Sum256([]byte(system))
+	return hex.EncodeToString(h[:])[:12]
+}
+
+// sleepCtx 可取消的 sleep。返回 false 表示 ctx 先被取消
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// --- 入场 FIFO 队列 (--queue-depth) ---
+// TPM/节流等待期间各 goroutine 各自 sleep，唤醒顺序不可预测，先到的请求
+// 可能被后到的插队。开启后在限流器之前按到达顺序放行，队满直接 503
+
+var (
+	admitMu   sync.Mutex
+	admitHead int64
+	admitTail int64
+)
+
+const (
+	admitOK        = 0
+	admitFull      = 1
+	admitCancelled = 2
+)
+
+// enterAdmissionQueue 取号排队。放行后由调用方在离开限流段时调用
+// leaveAdmissionQueue 交还队首
+func enterAdmissionQueue(ctx context.Context) int {
+	admitMu.Lock()
+	if int(admitTail-admitHead) >= queueDepth {
+		admitMu.Unlock()
+		return admitFull
+	}
+	admitTail++
+	ticket := admitTail
+	admitMu.Unlock()
+	for {
+		admitMu.Lock()
+		if ticket == admitHead+1 {
+			admitMu.Unlock()
+			return admitOK
+		}
+		admitMu.Unlock()
+		if !sleepCtx(ctx, 50*time.Millisecond) {
+			// 客户端已断开：异步等到自己的票号后直接过号，不阻塞后续请求
+			go func() {
+				for {
+					admitMu.Lock()
+					if ticket == admitHead+1 {
+						admitHead++
+						admitMu.Unlock()
+						return
+					}
+					admitMu.Unlock()
+					time.Sleep(50 * time.Millisecond)
+				}
+			}()
+			return admitCancelled
+		}
+	}
+}
+
+func leaveAdmissionQueue() {
+	admitMu.Lock()
+	admitHead++
+	admitMu.Unlock()
+}
+
+// --- 并发上限 (--max-concurrent) ---
+// 信号量限制同时在途的 handleProxy 数量。超出部分按到达顺序等待，
+// 最多等 --queue-timeout，超时返回 503 overloaded_error
+
+var (
+	concurrencySem   chan struct{}
+	concurrencyMu    sync.Mutex
+	concurrencyWait  int   // 当前排队等待的请求数
+	concurrencyDrops int64 // 等待超时被拒的请求数
+)
+
+// acquireConcurrency 占一个并发名额，复用入场队列的 admit* 返回码。
+// 拿到名额后由调用方 releaseConcurrency 归还
+func acquireConcurrency(ctx context.Context) int {
+	select {
+	case concurrencySem <- struct{}{}:
+		return admitOK
+	default:
+	}
+	concurrencyMu.Lock()
+	concurrencyWait++
+	concurrencyMu.Unlock()
+	defer func() {
+		concurrencyMu.Lock()
+		concurrencyWait--
+		concurrencyMu.Unlock()
+	}()
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case concurrencySem <- struct{}{}:
+		return admitOK
+	case <-timer.C:
+		concurrencyMu.Lock()
+		concurrencyDrops++
+		concurrencyMu.Unlock()
+		return admitFull
+	case <-ctx.Done():
+		return admitCancelled
+	}
+}
+
+func releaseConcurrency() {
+	<-concurrencySem
+}
+
+// buildDryRunResponse 构造 --dry-run 的合成响应。stop_reason 使用
+// 合成值 "dry_run"，客户端可据此识别这不是真正的模型输出
+func buildDryRunResponse(model string, payload []byte) map[string]interface{} {
+	res := map[string]interface{}{
+		"id":    fmt.Sprintf("dryrun-%d", time.Now().UnixNano()),
+		"type":  "message",
+		"role":  "assistant",
+		"model": model,
+		"content": []interface{}{map[string]interface{}{
+			"type": "text",
+			"text": fmt.Sprintf("🧪 dry-run: 未调用上游，换算后的 payload (%d 字节) 已打印到日志", len(payload)),
+		}},
+		"stop_reason": "dry_run",
+		"usage": map[string]interface{}{
+			"input_tokens":  0,
+			"output_tokens": 0,
+		},
+	}
+	if outputFormat == "minimax" {
+		res["base_resp"] = map[string]interface{}{"status_code": 0, "status_msg": ""}
+	}
+	return res
+}
+
+// selfSignedTLSConfig 生成一张仅本次进程有效的自签名证书（--tls-self-signed，
+// 内网直连用，免去反向代理）。指纹打印到启动日志，客户端可据此做证书固定
+func selfSignedTLSConfig() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatalf("生成自签名私钥失败: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "memubot-relay"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		log.Fatalf("生成自签名证书失败: %v", err)
+	}
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	fmt.Printf("[✓] --tls-self-signed 证书指纹 (SHA-256): %s\n", strings.Join(parts, ":"))
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1"}, // TLS 监听同时启用 HTTP/2
+	}
+}
+
+// resolveVirtualKey 鉴别请求密钥。命中虚拟密钥时替换为真实上游密钥。
+func resolveVirtualKey(reqKey string) (string, *virtualKey, bool) {
+	if len(virtualKeys) == 0 {
+		return reqKey, nil, true
+	}
+	if vk, ok := virtualKeys[reqKey]; ok {
+		vkStatsMu.Lock()
+		vkStats[vk.Bot]++
+		vkStatsMu.Unlock()
+		return apiKey, vk, true
+	}
+	if strings.HasPrefix(reqKey, "vk_") {
+		return "", nil, false
+	}
+	return reqKey, nil, true
+}
+
+// --- 响应缓存 ---
+// Gemini 转发器有上下文缓存，这边一直没有。temperature 0 的确定性调用
+// 会反复为完全相同的提示词付费，这里按规范化请求的哈希做一层响应缓存：
+// 命中时直接返回缓存的 MiniMax 响应，并跳过 TPM 扣减。
+// 流式请求和 temperature > 0 的请求默认不缓存。
+
+const respCacheCapacity = 256
+
+var (
+	cacheMode    bool          // --cache
+	cacheTTL     time.Duration // --cache-ttl
+	cacheAnyTemp bool          // --cache-any-temp: 允许缓存 temperature > 0 的请求
+	respCache    *responseLRU
+)
+
+type respCacheEntry struct {
+	key      string
+	body     []byte
+	expireAt time.Time
+}
+
+type responseLRU struct {
+	mu       sync.Mutex
+	ll       *list.List
+	entries  map[string]*list.Element
+	capacity int
+	hits     int64
+	misses   int64
+}
+
+func newResponseLRU(capacity int) *responseLRU {
+	return &responseLRU{
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+		capacity: capacity,
+	}
+}
+
+func (c *responseLRU) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := el.Value.(*respCacheEntry)
+	if time.Now().After(entry.expireAt) {
+		c.ll.Remove(el)
+		delete(c.entries, key)
+		c.misses++
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	c.hits++
+	return entry.body, true
+}
+
+func (c *responseLRU) Put(key string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*respCacheEntry).body = body
+		el.Value.(*respCacheEntry).expireAt = time.Now().Add(cacheTTL)
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&respCacheEntry{key: key, body: body, expireAt: time.Now().Add(cacheTTL)})
+	c.entries[key] = el
+	if c.ll.Len() > c.capacity {
+		last := c.ll.Back()
+		if last != nil {
+			c.ll.Remove(last)
+			delete(c.entries, last.Value.(*respCacheEntry).key)
+		}
+	}
+}
+
+// responseCacheKey 规范化请求 (model + messages + tools + temperature) 后取 SHA-256
+func responseCacheKey(oaiReq *OpenAIRequest) string {
+	raw, _ := json.Marshal(struct {
+		Model       string          `json:"model"`
+		Messages    []OpenAIMessage `json:"messages"`
+		Tools       []OpenAIToolDef `json:"tools,omitempty"`
+		Temperature *float64        `json:"temperature,omitempty"`
+	}{oaiReq.Model, oaiReq.Messages, oaiReq.Tools, oaiReq.Temperature})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// --- 少样本示例注入 ---
+// --examples 指定的 JSON 文件是 GenericMessage 数组。启动时校验并常驻，
+// 每个请求都注入在系统指令之后、真实历史之前。示例不参与历史裁剪。
+
+var (
+	examplesPath    string
+	exampleMessages []GenericMessage
+	exampleDigest   string
+)
+
+// loadExamples 读取并校验示例文件，格式错误时直接启动失败并指出条目
+func loadExamples() {
+	if examplesPath == "" {
+		return
+	}
+	data, err := os.ReadFile(examplesPath)
+	if err != nil {
+		log.Fatalf("examples 文件读取失败: %v", err)
+	}
+	if err := json.Unmarshal(data, &exampleMessages); err != nil {
+		log.Fatalf("examples 文件解析失败: %v", err)
+	}
+	for i, m := range exampleMessages {
+		switch m.Role {
+		case "user", "assistant", "tool", "function":
+		default:
+			log.Fatalf("examples 文件第 %d 条消息角色无效: %q", i, m.Role)
+		}
+		if len(m.Content) == 0 && len(m.ToolCalls) == 0 {
+			log.Fatalf("examples 文件第 %d 条消息缺少 content", i)
+		}
+	}
+	processed, _ := json.Marshal(exampleMessages)
+	sum := sha256.Sum256(processed)
+	exampleDigest = hex.EncodeToString(sum[:])[:16]
+}
+
+// injectExamples 把示例消息插在真实历史之前
+func injectExamples(messages []GenericMessage) []GenericMessage {
+	if len(exampleMessages) == 0 {
+		return messages
+	}
+	out := make([]GenericMessage, 0, len(exampleMessages)+len(messages))
+	out = append(out, exampleMessages...)
+	return append(out, messages...)
+}
+
+// --- 工具声明注册表 ---
+// memU 的几十个工具 schema 在每个请求里原样重复出现。按摘要驻留处理好的
+// 声明，第一次见到某个 schema 时做完整处理并登记，后续请求直接复用，
+// 避免每请求重复解码/清理。摘要变化 (插件升级) 自然换新条目。
+
+const toolRegistryMaxEntries = 1024
+
+var (
+	toolRegistry   = make(map[string]OpenAIToolDef)
+	toolRegistryMu sync.Mutex
+)
+
+// processToolDeclaration 对单个工具声明做一次性处理。
+// 后续的 schema 规范化等 pass 都挂在这里。
+func processToolDeclaration(name, desc string, params json.RawMessage) OpenAIToolDef {
+	var td OpenAIToolDef
+	td.Type = "function"
+	td.Function.Name = name
+	td.Function.Description = desc
+	// 无参数的工具：部分供应商要求 parameters 非 null，补一个空 object schema
+	trimmed := strings.TrimSpace(string(params))
+	if trimmed == "" || trimmed == "null" {
+		params = json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	td.Function.Parameters = params
+	return td
+}
+
+// internToolDeclaration 按摘要返回驻留的声明；未命中时处理并登记
+func internToolDeclaration(name, desc string, params json.RawMessage) OpenAIToolDef {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(desc))
+	h.Write([]byte{0})
+	h.Write(params)
+	digest := hex.EncodeToString(h.Sum(nil))[:24]
+
+	toolRegistryMu.Lock()
+	if d, ok := toolRegistry[digest]; ok {
+		toolRegistryMu.Unlock()
+		return d
+	}
+	toolRegistryMu.Unlock()
+
+	d := processToolDeclaration(name, desc, params)
+
+	toolRegistryMu.Lock()
+	if len(toolRegistry) >= toolRegistryMaxEntries {
+		// schema 集合通常很小，超限说明有异常客户端，直接重置即可
+		toolRegistry = make(map[string]OpenAIToolDef)
+	}
+	toolRegistry[digest] = d
+	toolRegistryMu.Unlock()
+	return d
+}
+
+// --- 辅助函数 ---
+
+// writeUpstreamError 把上游的非 200 错误包装成 MiniMax base_resp 封套返回，
+// 机器人侧就能统一解析。--raw-errors 时保留旧行为，原样透传上游错误体（便于调试）。
+func writeUpstreamError(w http.ResponseWriter, status int, body []byte) {
+	if rawErrors {
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+	if debugMode {
+		slog.Debug(fmt.Sprintf("上游错误原始响应 (HTTP %d): %s", status, maskKeys(strings.TrimSpace(string(body)))))
+	}
+	// 上游错误体一般是 {"error":{"message":...}}，尽量取里面的 message
+	msg := strings.TrimSpace(string(body))
+	var envelope struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error.Message != "" {
+		msg = envelope.Error.Message
+	}
+	if status == 429 {
+		w.Header().Set("Retry-After", "30")
+	}
+	if outputFormat == "anthropic" {
+		writeJSON(w, status, map[string]interface{}{
+			"type": "error",
+			"error": map[string]interface{}{
+				"type":    anthropicErrorType(status),
+				"message": msg,
+			},
+		})
+		return
+	}
+	if outputFormat == "openai" {
+		writeJSON(w, status, map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": msg,
+				"type":    "upstream_error",
+				"code":    status,
+			},
+		})
+		return
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"base_resp": map[string]interface{}{
+			"status_code": upstreamStatusCode(status),
+			"status_msg":  msg,
+		},
+	})
+}
+
+// writeRelayRateLimited 转发器自身产生的 429（非上游透传）。带上 Retry-After
+// 提示客户端何时重试，错误体同样按 --output-format 输出
+func writeRelayRateLimited(w http.ResponseWriter, retryAfterSec int, msg string) {
+	if retryAfterSec < 1 {
+		retryAfterSec = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSec))
+	if outputFormat == "anthropic" {
+		writeJSON(w, 429, map[string]interface{}{
+			"type": "error",
+			"error": map[string]interface{}{
+				"type":    "rate_limit_error",
+				"message": msg,
+			},
+		})
+		return
+	}
+	if outputFormat == "openai" {
+		writeJSON(w, 429, map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": msg,
+				"type":    "rate_limit_error",
+				"code":    429,
+			},
+		})
+		return
+	}
+	writeJSON(w, 429, map[string]interface{}{
+		"base_resp": map[string]interface{}{
+			"status_code": 1002,
+			"status_msg":  msg,
+		},
+	})
 }
 
-type GenericTool struct {
-	// OpenAI 风格
-	Type     string `json:"type"`
-	Function struct {
-		Name        string          `json:"name"`
-		Description string          `json:"description,omitempty"`
-		Parameters  json.RawMessage `json:"parameters,omitempty"`
-	} `json:"function"`
-	// Anthropic/MiniMax 风格 (顶层字段)
-	Name        string          `json:"name,omitempty"`
-	Description string          `json:"description,omitempty"`
-	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+// upstreamStatusCode 把上游 HTTP 状态码映射为 MiniMax 风格的非零业务错误码
+func upstreamStatusCode(status int) int {
+	switch status {
+	case 401, 403:
+		return 1004 // 鉴权失败
+	case 429:
+		return 1002 // 触发限流
+	case 400, 404, 422:
+		return 2013 // 输入格式信息不正常
+	default:
+		return 1000 // 未知错误
+	}
 }
 
-type GenericRequest struct {
-	Model    string           `json:"model"`
-	System   string           `json:"system,omitempty"`
-	Messages []GenericMessage `json:"messages"`
-	Tools    []GenericTool    `json:"tools,omitempty"`
+// anthropicErrorType 把上游 HTTP 状态码映射为 Anthropic SDK 认识的错误类型
+func anthropicErrorType(status int) string {
+	switch status {
+	case 400, 404, 422:
+		return "invalid_request_error"
+	case 401:
+		return "authentication_error"
+	case 403:
+		return "permission_error"
+	case 429:
+		return "rate_limit_error"
+	case 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
 }
 
-// --- OpenAI API Request/Response Structs ---
+// --- 单飞合并 ---
+// 机器人自身的重试层偶尔会并发发出两份完全相同的请求，两份都打到付费上游
+// 纯属浪费。按请求体哈希做单飞合并：后到的相同请求等待第一份完成并复用其
+// 响应。仅合并非流式请求（本转发器的响应均为非流式）。
 
-type OpenAIMessage struct {
-	Role       string           `json:"role"`
-	Content    interface{}      `json:"content,omitempty"` // string or null
-	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string           `json:"tool_call_id,omitempty"`
-	Name       string           `json:"name,omitempty"`
+type inflightCall struct {
+	done    chan struct{}
+	status  int
+	header  http.Header
+	body    []byte
+	aborted bool // 领跑请求未写响应就退出，跟随者须自行执行
 }
 
-type OpenAIToolCall struct {
-	ID       string `json:"id"`
-	Type     string `json:"type"`
-	Function struct {
-		Name      string `json:"name"`
-		Arguments string `json:"arguments"`
-	} `json:"function"`
+var (
+	inflightMu    sync.Mutex
+	inflightCalls = make(map[string]*inflightCall)
+)
+
+// inflightWriter 在写出响应的同时抄录一份，供被合并的请求复用
+type inflightWriter struct {
+	http.ResponseWriter
+	call        *inflightCall
+	wroteHeader bool
 }
 
-type OpenAIToolDef struct {
-	Type     string `json:"type"`
-	Function struct {
-		Name        string          `json:"name"`
-		Description string          `json:"description,omitempty"`
-		Parameters  json.RawMessage `json:"parameters,omitempty"`
-	} `json:"function"`
+func (iw *inflightWriter) WriteHeader(status int) {
+	if !iw.wroteHeader {
+		iw.wroteHeader = true
+		iw.call.status = status
+	}
+	iw.ResponseWriter.WriteHeader(status)
 }
 
-type OpenAIRequest struct {
-	Model    string          `json:"model"`
-	Messages []OpenAIMessage `json:"messages"`
-	Tools    []OpenAIToolDef `json:"tools,omitempty"`
+func (iw *inflightWriter) Write(b []byte) (int, error) {
+	if !iw.wroteHeader {
+		iw.wroteHeader = true
+		iw.call.status = 200
+	}
+	iw.call.body = append(iw.call.body, b...)
+	return iw.ResponseWriter.Write(b)
 }
 
-type OpenAIResponse struct {
-	ID      string `json:"id"`
-	Choices []struct {
-		Message struct {
-			Role             string           `json:"role"`
-			Content          *string          `json:"content"`
-			ReasoningContent *string          `json:"reasoning_content,omitempty"`
-			ToolCalls        []OpenAIToolCall `json:"tool_calls,omitempty"`
-		} `json:"message"`
-		FinishReason string `json:"finish_reason"`
-	} `json:"choices"`
-	Usage struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
+// replayInflight 把第一份请求的响应原样回放给被合并的请求。
+// 领跑请求中止时返回 false，调用方须自行执行
+func replayInflight(w http.ResponseWriter, call *inflightCall) bool {
+	<-call.done
+	if call.aborted {
+		return false
+	}
+	for k, vals := range call.header {
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+	status := call.status
+	if status == 0 {
+		status = 200
+	}
+	w.WriteHeader(status)
+	w.Write(call.body)
+	return true
 }
 
-// --- 辅助函数 ---
+// writeJSON 统一的 JSON 响应编码：所有路径都关闭 HTML 转义，
+// 避免部分客户端处理不了 \u003c 这类转义
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
 
 func extractText(raw json.RawMessage) string {
 	var s string
@@ -235,8 +2596,102 @@ func extractText(raw json.RawMessage) string {
 	return string(raw)
 }
 
+// imageBlockToPart 将 image / input_image / image_url 块转换为 OpenAI 的 image_url content part
+// 返回 nil 表示块里没有可用的图片数据
+func imageBlockToPart(block ContentBlock) map[string]interface{} {
+	var imgURL string
+	if block.Source != nil {
+		switch block.Source.Type {
+		case "base64":
+			if block.Source.Data != "" {
+				imgURL = "data:" + block.Source.MediaType + ";base64," + block.Source.Data
+			}
+		case "url":
+			imgURL = block.Source.URL
+		}
+	} else if block.ImageURL != nil {
+		imgURL = block.ImageURL.URL
+	}
+	if imgURL == "" {
+		return nil
+	}
+	return map[string]interface{}{
+		"type":      "image_url",
+		"image_url": map[string]string{"url": imgURL},
+	}
+}
+
 // fixJSON 尝试修复非标准 JSON (如键未加引号)
+// fixJSONQuotes 把单引号字符串/键转为双引号，并去掉对象/数组收尾前的
+// 多余逗号。合法双引号字符串内的内容（含转义）原样保留
+func fixJSONQuotes(s string) string {
+	var res strings.Builder
+	inDouble := false
+	inSingle := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inDouble {
+			res.WriteByte(c)
+			if c == '\\' && i+1 < len(s) {
+				i++
+				res.WriteByte(s[i])
+				continue
+			}
+			if c == '"' {
+				inDouble = false
+			}
+			continue
+		}
+		if inSingle {
+			if c == '\\' && i+1 < len(s) {
+				// \' 在双引号字符串里不需要转义
+				if s[i+1] == '\'' {
+					res.WriteByte('\'')
+				} else {
+					res.WriteByte(c)
+					res.WriteByte(s[i+1])
+				}
+				i++
+				continue
+			}
+			if c == '\'' {
+				inSingle = false
+				res.WriteByte('"')
+				continue
+			}
+			if c == '"' {
+				res.WriteString("\\\"")
+				continue
+			}
+			res.WriteByte(c)
+			continue
+		}
+		switch c {
+		case '"':
+			inDouble = true
+			res.WriteByte(c)
+		case '\'':
+			inSingle = true
+			res.WriteByte('"')
+		case ',':
+			// 下一个非空白字符是 } 或 ] 时丢弃这个逗号
+			j := i + 1
+			for j < len(s) && (s[j] == ' ' || s[j] == '\t' || s[j] == '\n' || s[j] == '\r') {
+				j++
+			}
+			if j < len(s) && (s[j] == '}' || s[j] == ']') {
+				continue
+			}
+			res.WriteByte(c)
+		default:
+			res.WriteByte(c)
+		}
+	}
+	return res.String()
+}
+
 func fixJSON(s string) string {
+	s = fixJSONQuotes(s)
 	var res strings.Builder
 	var keyStart = -1
 	inStr := false
@@ -325,25 +2780,141 @@ func parseMalformedFunctionCall(msg string) (string, map[string]any) {
 		return name, args
 	}
 
-	fmt.Printf("[WARN] 无法解析 Malformed Args: %s\n", argsRaw)
+	slog.Warn(fmt.Sprintf("无法解析 Malformed Args: %s", argsRaw))
 	return "", nil
 }
 
+// printEffectiveConfig 以 JSON 打印生效配置（密钥类值脱敏），供编排脚本核对
+func printEffectiveConfig() {
+	secretFlags := map[string]bool{"key": true, "virtual-key": true, "proxy-auth": true}
+	cfg := map[string]interface{}{}
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = redactSecret(v)
+		}
+		cfg[f.Name] = v
+	})
+	cfg["api_key"] = redactSecret(apiKey)
+	out, _ := json.MarshalIndent(cfg, "", "  ")
+	fmt.Println(string(out))
+}
+
+// redactSecret 只保留前 4 位，避免完整密钥进入日志
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	if len(s) <= 8 {
+		return "****"
+	}
+	return s[:4] + "****"
+}
+
 func main() {
 	flag.BoolVar(&debugMode, "debug", false, "是否开启调试模式")
 	flag.StringVar(&proxyURL, "proxy", "", "代理服务器地址 (如 http://127.0.0.1:7890)")
+	flag.StringVar(&proxyAuth, "proxy-auth", "", "代理认证 \"user:pass\" (也可写进 --proxy 的 URL)")
 	flag.StringVar(&tpmFlag, "tpm", "", "TPM 速率限制 (如 0.9M 或 900,000)")
 	flag.StringVar(&baseURL, "url", "", "API 完整端点 URL (如 https://api.siliconflow.cn/v1/chat/completions)")
+	flag.Var(&modelURLFlags, "model-url", "按模型路由的端点映射 \"模型名=URL\" (可重复)")
+	flag.Var(&virtualKeyFlags, "virtual-key", "虚拟密钥 \"机器人名:密钥[:tpm=0.3M]\" (可重复)")
+	flag.Var(&clientKeyFlags, "client-keys", "允许的入站密钥 \"客户端密钥[=上游密钥]\" (可重复，设置后其余密钥一律 401)")
+	flag.Var(&extraHeaderFlags, "header", "附加到上游请求的额外请求头 \"Key: Value\" (可重复)")
+	flag.BoolVar(&verifyTools, "verify-tools", false, "每套工具集探测一次模型实际可见的工具")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS 证书文件 (与 --tls-key 同时指定时启用 HTTPS)")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS 私钥文件")
+	flag.BoolVar(&tlsSelfSigned, "tls-self-signed", false, "启动时生成临时自签名证书并打印指纹，便于内网直连")
+	flag.IntVar(&maxOutput, "max-output", 0, "输出 token 上限 (0 表示不设置 max_tokens)")
+	flag.DurationVar(&upstreamTimeout, "timeout", 120*time.Second, "上游请求超时时间")
 	flag.StringVar(&apiKey, "key", "", "API Key (也可通过请求头传入)")
+	flag.StringVar(&examplesPath, "examples", "", "少样本示例文件 (GenericMessage 数组的 JSON)")
+	flag.StringVar(&outputFormat, "output-format", "minimax", "响应格式: minimax / anthropic / openai")
+	flag.BoolVar(&rawErrors, "raw-errors", false, "上游错误原样透传（默认包装为 base_resp 封套）")
+	flag.BoolVar(&cacheMode, "cache", false, "是否启用响应缓存 (仅缓存确定性请求)")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 10*time.Minute, "响应缓存的有效期")
+	flag.BoolVar(&cacheAnyTemp, "cache-any-temp", false, "允许缓存 temperature > 0 的请求")
+	flag.StringVar(&printConfig, "print-config", "", "打印生效配置 JSON: json (打印后继续) / only (打印后退出)")
+	flag.StringVar(&corsOrigin, "cors-origin", "", "允许跨域的 Origin (如 * 或 https://bot-ui.example，默认不开 CORS)")
+	flag.StringVar(&conformanceURL, "conformance", "", "对指定地址的转发器实例跑一致性检查后退出 (如 http://127.0.0.1:6300)")
+	flag.BoolVar(&conformanceOffline, "conformance-offline", false, "一致性检查用进程内桩上游替身执行，适合 CI，无需真实上游")
+	flag.Int64Var(&maxBody, "max-body", 20<<20, "请求体大小上限字节数，超出返回 413 (默认 20MB，0 表示不限制)")
+	flag.BoolVar(&mergeRoles, "merge-roles", true, "合并连续相同角色的消息 (对不允许连续相同角色的后端关闭会报错)")
+	flag.StringVar(&systemRole, "system-role", "auto", "系统指令的角色: system / developer / auto (按模型名推断)")
+	flag.IntVar(&maxHistory, "max-history", 0, "只保留最近 N 条历史消息，0 表示不截断 (截断点保证不拆散工具调用配对)")
+	flag.BoolVar(&summarizeHistory, "summarize", false, "配合 --max-history：用一次廉价上游调用把截掉的旧轮次摘要成一条合成消息前置，而非直接丢弃")
+	flag.StringVar(&logFilePath, "log-file", "", "审计日志路径，每个请求追加一行 JSON (空表示不记录)")
+	flag.BoolVar(&logBodies, "log-bodies", false, "审计日志中附带完整的转换后请求体和响应体")
+	flag.IntVar(&logMaxSize, "log-max-size", 100, "审计日志单文件大小上限 (MB)，超过后轮转")
+	flag.IntVar(&logKeep, "log-keep", 5, "审计日志轮转保留的历史文件数")
+	flag.StringVar(&pickMode, "pick", "first", "多候选时的选取方式: first / longest")
+	flag.StringVar(&logLevel, "log-level", "info", "日志级别: debug / info / warn / error")
+	flag.StringVar(&logFormat, "log-format", "text", "日志输出格式: text / json")
+	flag.BoolVar(&verboseUsage, "verbose-usage", false, "退出小结中额外打印每个模型的用量明细")
+	flag.Float64Var(&priceIn, "price-in", 0, "输入价格 (美元/1M tokens)，用于退出小结的费用估算")
+	flag.Float64Var(&priceOut, "price-out", 0, "输出价格 (美元/1M tokens)，用于退出小结的费用估算")
+	flag.BoolVar(&redactContent, "redact", false, "调试输出中用长度占位符替换消息正文和工具参数 (密钥打码始终开启)")
+	flag.StringVar(&pricingFile, "pricing", "", "模型单价覆盖表 (JSON 文件，美元/1M tokens)")
+	flag.DurationVar(&convUsageTTL, "usage-ttl", 24*time.Hour, "会话用量统计的空闲保留时长，0 表示不过期")
+	flag.IntVar(&queueDepth, "queue-depth", 0, "限流段前的 FIFO 入场队列深度，满了返回 503，0 表示不启用")
+	flag.IntVar(&maxConcurrent, "max-concurrent", 0, "同时处理的请求上限，0 表示不限制")
+	flag.DurationVar(&queueTimeout, "queue-timeout", 30*time.Second, "超出并发上限时的最长排队等待时长")
+	flag.StringVar(&relayToken, "relay-token", "", "转发器自身的访问令牌，设置后请求须携带 X-Relay-Token 头或 Bearer 令牌")
+	flag.BoolVar(&dryRun, "dry-run", false, "只打印换算后的上游 payload，不真正发送，返回合成响应")
 	flag.Parse()
 
-	// 验证必需参数
-	if baseURL == "" {
+	// --debug 仍然有效，等价于 --log-level debug
+	if debugMode {
+		logLevel = "debug"
+	}
+	var slogLevel slog.Level
+	switch logLevel {
+	case "debug":
+		slogLevel = slog.LevelDebug
+		debugMode = true
+	case "info":
+		slogLevel = slog.LevelInfo
+	case "warn":
+		slogLevel = slog.LevelWarn
+	case "error":
+		slogLevel = slog.LevelError
+	default:
+		log.Fatalf("log-level 参数错误: %q (支持 debug / info / warn / error)", logLevel)
+	}
+	var slogHandler slog.Handler
+	switch logFormat {
+	case "text":
+		slogHandler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slogLevel})
+	case "json":
+		slogHandler = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slogLevel})
+	default:
+		log.Fatalf("log-format 参数错误: %q (支持 text / json)", logFormat)
+	}
+	slog.SetDefault(slog.New(slogHandler))
+
+	if pricingFile != "" {
+		loadPricingFile(pricingFile)
+	}
+	if maxConcurrent > 0 {
+		concurrencySem = make(chan struct{}, maxConcurrent)
+	}
+
+	// 验证必需参数（--conformance-offline 下端点指向进程内桩上游）
+	if baseURL == "" && !conformanceOffline {
 		log.Fatal("必须指定 --url 参数，如 --url https://api.siliconflow.cn/v1/chat/completions")
 	}
 	// 移除末尾的斜杠
 	baseURL = strings.TrimRight(baseURL, "/")
 
+	// 解析按模型的端点映射
+	for _, mapping := range modelURLFlags {
+		model, u, ok := strings.Cut(mapping, "=")
+		if !ok || model == "" || u == "" {
+			log.Fatalf("model-url 参数错误: %q (格式应为 模型名=URL)", mapping)
+		}
+		modelURLs[model] = strings.TrimRight(u, "/")
+	}
+
 	// 解析 TPM
 	if tpmFlag != "" {
 		tpmValue, err := parseTPM(tpmFlag)
@@ -353,6 +2924,64 @@ func main() {
 		tpmLimiter = NewTokenBucketLimiter(tpmValue)
 	}
 
+	parseVirtualKeys()
+	parseClientKeys()
+	parseExtraHeaders()
+	if relayToken != "" {
+		fmt.Println("[✓] --relay-token 转发器访问令牌校验已启用")
+	}
+	if dryRun {
+		fmt.Println("[✓] --dry-run 仅打印 payload，不调用上游")
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatalf("--tls-cert 和 --tls-key 必须同时指定")
+	}
+	if tlsSelfSigned && tlsCert != "" {
+		log.Fatalf("--tls-self-signed 与 --tls-cert/--tls-key 不能同时指定")
+	}
+
+	switch systemRole {
+	case "auto", "system", "developer":
+	default:
+		log.Fatalf("system-role 参数错误: %q (支持 system / developer / auto)", systemRole)
+	}
+
+	switch printConfig {
+	case "", "json", "only":
+	default:
+		log.Fatalf("print-config 参数错误: %q (支持 json / only)", printConfig)
+	}
+	if printConfig != "" {
+		printEffectiveConfig()
+		if printConfig == "only" {
+			os.Exit(0)
+		}
+	}
+
+	if conformanceURL != "" || conformanceOffline {
+		runConformance(conformanceURL)
+	}
+
+	switch outputFormat {
+	case "minimax", "anthropic", "openai":
+	default:
+		log.Fatalf("output-format 参数错误: %q (支持 minimax / anthropic / openai)", outputFormat)
+	}
+
+	switch pickMode {
+	case "first", "longest":
+	default:
+		log.Fatalf("pick 参数错误: %q (支持 first / longest)", pickMode)
+	}
+
+	if cacheMode {
+		respCache = newResponseLRU(respCacheCapacity)
+	}
+
+	// 加载少样本示例 (校验失败会直接退出)
+	loadExamples()
+
 	fmt.Println("     用于 memU bot 的 OpenAI-Compatible API 中继工具")
 	fmt.Println("               memU bot 中配置如下：")
 	fmt.Println("--------------------------------------------------------")
@@ -381,53 +3010,344 @@ func main() {
 		fmt.Println("[ ] --tpm 速率限制，如 --tpm 0.9M")
 	}
 
-	fmt.Printf("[✓] --url %s\n", baseURL)
+	fmt.Printf("[✓] --url %s\n", baseURL)
+
+	fmt.Println("--------------------------------------------------------")
+	fmt.Println("当前正在中继 OpenAI-Compatible API")
+
+	// 周期回收空闲会话的用量统计
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			gcConvUsage()
+		}
+	}()
+
+	http.HandleFunc("/v1/", handleProxy)
+	http.HandleFunc("/v1/ws", handleWS)
+	http.HandleFunc("/v1/embeddings", handleEmbeddings)
+	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/stats/usage.csv", handleUsageCSV)
+	// 信号驱动的优雅关闭（退出时打印用量小结）
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: ":6300", Handler: rootHandler()}
+	if tlsSelfSigned {
+		server.TLSConfig = selfSignedTLSConfig()
+	}
+	go func() {
+		var err error
+		if tlsSelfSigned {
+			err = server.ListenAndServeTLS("", "")
+		} else if tlsCert != "" {
+			err = server.ListenAndServeTLS(tlsCert, tlsKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	fmt.Println("\n[EXIT] 正在关闭...")
+	printUsageSummary()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown error: %v", err)
+	}
+	slog.Info("[EXIT] 完成")
+}
+
+// modelsURL 由聊天端点推导上游模型列表端点
+// 如 https://api.siliconflow.cn/v1/chat/completions → https://api.siliconflow.cn/v1/models
+func modelsURL() string {
+	u := strings.TrimSuffix(baseURL, "/chat/completions")
+	u = strings.TrimSuffix(u, "/completions")
+	return strings.TrimRight(u, "/") + "/models"
+}
+
+// handleModels 处理 GET /v1/models：转发上游模型列表并统一为 OpenAI 风格
+func handleModels(w http.ResponseWriter, reqKey string) {
+	transport := buildProxyTransport()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   30 * time.Second,
+	}
+
+	httpReq, _ := http.NewRequest("GET", modelsURL(), nil)
+	httpReq.Header.Set("Authorization", "Bearer "+reqKey)
+	applyExtraHeaders(httpReq.Header)
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		slog.Error(fmt.Sprintf("获取模型列表失败: %v", err))
+		http.Error(w, err.Error(), 502)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		slog.Error(fmt.Sprintf("上游报错 (状态码 %d): %s", resp.StatusCode, string(body)))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
+
+	var listResp struct {
+		Data []struct {
+			ID      string `json:"id"`
+			OwnedBy string `json:"owned_by"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &listResp); err != nil {
+		slog.Error(fmt.Sprintf("解析模型列表失败: %v", err))
+		http.Error(w, "Failed to parse model list", 500)
+		return
+	}
+
+	data := make([]map[string]interface{}, 0, len(listResp.Data))
+	for _, m := range listResp.Data {
+		data = append(data, map[string]interface{}{
+			"id":       m.ID,
+			"object":   "model",
+			"owned_by": m.OwnedBy,
+		})
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+// embeddingsURL 由聊天端点推导上游 embeddings 端点
+func embeddingsURL() string {
+	u := strings.TrimSuffix(baseURL, "/chat/completions")
+	u = strings.TrimSuffix(u, "/completions")
+	return strings.TrimRight(u, "/") + "/embeddings"
+}
+
+// handleEmbeddings 处理 /v1/embeddings：转发 {model, input} 到上游并透传响应
+func handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	reqKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if reqKey == "" {
+		reqKey = r.Header.Get("x-api-key")
+	}
+
+	// 与 handleProxy 相同的鉴权链：转发器令牌 → 入站白名单 → 虚拟密钥
+	if relayToken != "" {
+		token := r.Header.Get("X-Relay-Token")
+		if token == "" && reqKey == relayToken {
+			token = reqKey
+			reqKey = ""
+		}
+		if token != relayToken {
+			slog.Error("转发器访问令牌缺失或不匹配，拒绝请求")
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+	}
+	// 入站密钥白名单（防止任何能连到端口的人白嫖上游 Key）
+	if len(clientKeys) > 0 {
+		mapped, ok := clientKeys[reqKey]
+		if !ok {
+			slog.Error(fmt.Sprintf("未授权的客户端密钥: %s", redactSecret(reqKey)))
+			http.Error(w, "Unauthorized client key", 401)
+			return
+		}
+		if mapped != "" {
+			reqKey = mapped
+		}
+	}
+	if reqKey == "" {
+		reqKey = apiKey
+	}
+	if reqKey == "" {
+		slog.Error("未提供 API Key (通过请求头传入)")
+		http.Error(w, "Missing API Key", 401)
+		return
+	}
+	upstreamKey, _, vkAuthorized := resolveVirtualKey(reqKey)
+	if !vkAuthorized {
+		slog.Error(fmt.Sprintf("未知的虚拟密钥: %s", reqKey))
+		http.Error(w, "Unknown virtual key", 401)
+		return
+	}
+	reqKey = upstreamKey
+
+	if maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Request body too large", 413)
+		return
+	}
+
+	// TPM: embeddings 只计输入 token
+	if tpmLimiter != nil {
+		estimatedTokens := float64(len(bodyBytes)) / 3.0
+		for {
+			allowed, waitTime := tpmLimiter.Consume(estimatedTokens)
+			if allowed {
+				break
+			}
+			if waitTime < 0 {
+				writeRelayRateLimited(w, 60, "Request too large for TPM limit")
+				return
+			}
+			slog.Info(fmt.Sprintf("[TPM] ⏳ 令牌不足，等待 %.1f 秒...", waitTime))
+			time.Sleep(time.Duration(waitTime*1000) * time.Millisecond)
+		}
+	}
+
+	transport := buildProxyTransport()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   upstreamTimeout,
+	}
+
+	httpReq, _ := http.NewRequest("POST", embeddingsURL(), bytes.NewBuffer(bodyBytes))
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+reqKey)
+	applyExtraHeaders(httpReq.Header)
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		slog.Error(fmt.Sprintf("网络连接失败: %v", err))
+		http.Error(w, err.Error(), 502)
+		return
+	}
+	defer resp.Body.Close()
 
-	fmt.Println("--------------------------------------------------------")
-	fmt.Println("当前正在中继 OpenAI-Compatible API")
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		slog.Error(fmt.Sprintf("上游 embeddings 报错 (状态码 %d): %s", resp.StatusCode, string(respBody)))
+	}
+	// 上游已是 OpenAI 形状，直接透传
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
+}
 
-	http.HandleFunc("/v1/", handleProxy)
-	log.Fatal(http.ListenAndServe(":6300", nil))
+// isChatPath 判断是否为支持的聊天补全路径
+// memU bot 及各类客户端可能使用 Anthropic / OpenAI / MiniMax 风格的路径
+func isChatPath(path string) bool {
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"),
+		strings.HasSuffix(path, "/messages"),
+		strings.Contains(path, "chatcompletion"): // MiniMax 风格 /v1/text/chatcompletion_v2
+		return true
+	}
+	// 直接挂在根前缀上的请求也按聊天处理 (历史行为)
+	return path == "/v1" || path == "/v1/"
 }
 
-func handleProxy(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
+// handleStats 转发器运行统计
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	vkStatsMu.Lock()
+	botRequests := make(map[string]int, len(vkStats))
+	for k, v := range vkStats {
+		botRequests[k] = v
+	}
+	vkStatsMu.Unlock()
 
-	reqKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if reqKey == "" {
-		reqKey = r.Header.Get("x-api-key")
+	convUsageMu.Lock()
+	conversations := make(map[string]convUsage, len(convUsageMap))
+	for k, v := range convUsageMap {
+		conversations[k] = *v
 	}
-	if reqKey == "" {
-		reqKey = apiKey
+	convUsageMu.Unlock()
+
+	res := map[string]interface{}{
+		"bots":          botRequests,
+		"conversations": conversations,
 	}
-	if reqKey == "" {
-		fmt.Println("[ERR] 未提供 API Key (通过请求头传入)")
-		http.Error(w, "Missing API Key", 401)
-		return
+	if maxConcurrent > 0 {
+		concurrencyMu.Lock()
+		res["concurrency"] = map[string]interface{}{
+			"limit":      maxConcurrent,
+			"in_flight":  len(concurrencySem),
+			"queued":     concurrencyWait,
+			"rejections": concurrencyDrops,
+		}
+		concurrencyMu.Unlock()
+	}
+	if perModel, total := costSnapshot(); total > 0 || len(perModel) > 0 {
+		res["cost"] = map[string]interface{}{
+			"by_model":                 perModel,
+			"total_estimated_cost_usd": total,
+		}
+	}
+	if respCache != nil {
+		respCache.mu.Lock()
+		res["response_cache"] = map[string]interface{}{
+			"size":     respCache.ll.Len(),
+			"capacity": respCache.capacity,
+			"hits":     respCache.hits,
+			"misses":   respCache.misses,
+		}
+		respCache.mu.Unlock()
 	}
+	writeJSON(w, 200, res)
+}
 
-	bodyBytes, _ := io.ReadAll(r.Body)
-	var genReq GenericRequest
-	if err := json.Unmarshal(bodyBytes, &genReq); err != nil {
-		fmt.Printf("[ERR] JSON 解析失败: %v\n", err)
-		http.Error(w, "Invalid JSON", 400)
-		return
+// systemRoleFor 决定系统指令用哪个角色发送。o1/o3/gpt-5 等推理模型
+// 要求 developer 角色，其余沿用 system
+func systemRoleFor(model string) string {
+	if systemRole != "auto" {
+		return systemRole
+	}
+	for _, prefix := range []string{"o1", "o3", "gpt-5"} {
+		if strings.HasPrefix(model, prefix) {
+			return "developer"
+		}
 	}
+	return "system"
+}
 
-	if debugMode {
-		fmt.Printf("[DEBUG] %s 收到请求: %s %s | 模型: %s\n", time.Now().Format("15:04:05"), r.Method, path, genReq.Model)
-		fmt.Printf("[DEBUG] %s 收到的数据 (Client Request):\n%s\n", time.Now().Format("15:04:05"), string(bodyBytes))
+// truncateHistory 保留开头的 system/developer 指令和最近 n 条消息。
+// 截断点不能落在 tool 消息上——tool 消息必须跟着它的 assistant tool_calls
+func truncateHistory(messages []OpenAIMessage, n int) []OpenAIMessage {
+	head := 0
+	for head < len(messages) && (messages[head].Role == "system" || messages[head].Role == "developer") {
+		head++
+	}
+	rest := messages[head:]
+	if n <= 0 || len(rest) <= n {
+		return messages
 	}
+	start := len(rest) - n
+	for start < len(rest) && rest[start].Role == "tool" {
+		start++
+	}
+	slog.Warn(fmt.Sprintf("历史超过 %d 条，截断了最早的 %d 条", n, start))
+	return append(messages[:head:head], rest[start:]...)
+}
 
-	// === 1. 构建 OpenAI Request ===
+// buildOpenAIRequest 把 GenericRequest 转换为 OpenAI 请求结构。
+// reqKey 供 --verify-tools 的探测请求使用
+func buildOpenAIRequest(genReq GenericRequest, reqKey string) OpenAIRequest {
 	var oaiReq OpenAIRequest
 	oaiReq.Model = genReq.Model
+	oaiReq.Stream = genReq.Stream
+	oaiReq.Temperature = genReq.Temperature
+	if genReq.N > 1 {
+		oaiReq.N = genReq.N
+	}
+	if len(genReq.ResponseFormat) > 0 {
+		oaiReq.ResponseFormat = genReq.ResponseFormat
+	}
 
-	// System message → 第一条消息
-	if genReq.System != "" {
+	// System message → 第一条消息 (o1/o3/gpt-5 系列要求 developer 角色)
+	if sys := systemText(genReq.System); sys != "" {
 		oaiReq.Messages = append(oaiReq.Messages, OpenAIMessage{
-			Role:    "system",
-			Content: genReq.System,
+			Role:    systemRoleFor(genReq.Model),
+			Content: sys,
 		})
 	}
 
@@ -435,28 +3355,31 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 	if len(genReq.Tools) > 0 {
 		var toolNames []string
 		for _, t := range genReq.Tools {
-			var td OpenAIToolDef
-			td.Type = "function"
+			var name, desc string
+			var params json.RawMessage
 
 			if t.Type == "function" && t.Function.Name != "" {
 				// OpenAI 风格: {"type": "function", "function": {...}}
-				td.Function.Name = t.Function.Name
-				td.Function.Description = t.Function.Description
-				td.Function.Parameters = t.Function.Parameters
+				name = t.Function.Name
+				desc = t.Function.Description
+				params = t.Function.Parameters
 			} else if t.Name != "" {
 				// Anthropic/MiniMax 风格: {"name": "...", "description": "...", "input_schema": {...}}
-				td.Function.Name = t.Name
-				td.Function.Description = t.Description
-				td.Function.Parameters = t.InputSchema
+				name = t.Name
+				desc = t.Description
+				params = t.InputSchema
 			} else {
 				continue
 			}
 
-			toolNames = append(toolNames, td.Function.Name)
-			oaiReq.Tools = append(oaiReq.Tools, td)
+			toolNames = append(toolNames, name)
+			oaiReq.Tools = append(oaiReq.Tools, internToolDeclaration(name, desc, params))
 		}
 		if debugMode {
-			fmt.Printf("[DEBUG] 客户端定义工具: %v\n", toolNames)
+			slog.Debug(fmt.Sprintf("客户端定义工具: %v", toolNames))
+		}
+		if verifyTools && len(oaiReq.Tools) > 0 {
+			go verifyToolSet(reqKey, genReq.Model, oaiReq.Tools)
 		}
 	}
 
@@ -488,55 +3411,128 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 		case "system":
 			continue // 系统消息已经在上面处理
 
+		case "developer":
+			// 新版 OpenAI 客户端的 developer 角色，上游认识，原样透传
+			oaiReq.Messages = append(oaiReq.Messages, OpenAIMessage{
+				Role:    "developer",
+				Content: extractText(m.Content),
+			})
+
 		case "user":
 			// 尝试解析 content 为数组 (Anthropic/MiniMax 格式)
 			var contentBlocks []ContentBlock
 			if err := json.Unmarshal(m.Content, &contentBlocks); err == nil {
-				// 分离: text 内容 → user 消息, tool_result → tool 消息
-				var textParts []string
-				var toolResults []ContentBlock
+				// 按块的原始顺序输出：text/图片累积为 user 内容，碰到
+				// tool_result 先冲刷累积内容再发 tool 消息，交错顺序原样保留
+				var userParts []map[string]interface{}
+				hasImage := false
+				flushUser := func() {
+					if len(userParts) == 0 {
+						return
+					}
+					if hasImage {
+						// 含图片时 content 必须是 content-part 数组
+						oaiReq.Messages = append(oaiReq.Messages, OpenAIMessage{
+							Role:    "user",
+							Content: userParts,
+						})
+					} else {
+						// 纯文本时按原顺序拼接为字符串 content
+						var texts []string
+						for _, p := range userParts {
+							if t, ok := p["text"].(string); ok {
+								texts = append(texts, t)
+							}
+						}
+						oaiReq.Messages = append(oaiReq.Messages, OpenAIMessage{
+							Role:    "user",
+							Content: strings.Join(texts, "\n"),
+						})
+					}
+					userParts = nil
+					hasImage = false
+				}
 
 				for _, block := range contentBlocks {
+					if block.CacheControl != nil && debugMode {
+						slog.Debug(fmt.Sprintf("收到 cache_control (%s) 标记，上游不支持，已剥离", block.CacheControl.Type))
+					}
 					switch block.Type {
 					case "text":
 						if block.Text != "" {
-							textParts = append(textParts, block.Text)
+							userParts = append(userParts, map[string]interface{}{
+								"type": "text",
+								"text": block.Text,
+							})
+						}
+					case "image", "input_image", "image_url":
+						if p := imageBlockToPart(block); p != nil {
+							userParts = append(userParts, p)
+							hasImage = true
+						} else {
+							slog.Warn("图片块缺少可用数据，已忽略")
 						}
 					case "tool_result":
-						toolResults = append(toolResults, block)
-					}
-				}
-
-				// 先添加 tool results (作为 OpenAI tool 消息)
-				for _, tr := range toolResults {
-					var contentStr string
-					if len(tr.Content) > 0 {
-						// 先尝试解析为字符串
-						var s string
-						if err := json.Unmarshal(tr.Content, &s); err == nil {
-							contentStr = s
+						flushUser()
+						var trImages []map[string]interface{} // 工具结果里挪出来的图片
+						var contentStr string
+						if len(block.Content) > 0 {
+							var resultBlocks []ContentBlock
+							var str string
+							if err := json.Unmarshal(block.Content, &resultBlocks); err == nil && len(resultBlocks) > 0 && resultBlocks[0].Type != "" {
+								// 块数组（截图类工具）：文本拼接进 tool 消息，图片
+								// 挪到随后的 user 消息里——OpenAI 的 tool 消息大多
+								// 数上游只接受纯文本
+								var texts []string
+								for _, rb := range resultBlocks {
+									switch rb.Type {
+									case "text":
+										texts = append(texts, rb.Text)
+									case "image", "input_image", "image_url":
+										if p := imageBlockToPart(rb); p != nil {
+											trImages = append(trImages, p)
+										} else {
+											slog.Warn("工具结果中的图片块缺少可用数据，已忽略")
+										}
+									}
+								}
+								contentStr = strings.Join(texts, "\n")
+								if contentStr == "" {
+									// 只有图片没有文本时也得给个占位结果
+									contentStr = "ok"
+								}
+							} else if err := json.Unmarshal(block.Content, &str); err == nil {
+								// 先尝试解析为字符串
+								contentStr = str
+							} else {
+								// 直接用 JSON 文本
+								contentStr = string(block.Content)
+							}
 						} else {
-							// 直接用 JSON 文本
-							contentStr = string(tr.Content)
+							contentStr = "ok"
+						}
+						// 失败的工具结果加显式错误前缀，OpenAI 的 tool 消息
+						// 没有专门的错误字段，全靠内容本身传达
+						if block.IsError {
+							contentStr = "[TOOL ERROR] " + contentStr
+							if debugMode {
+								slog.Debug(fmt.Sprintf("工具结果标记为错误: %s", block.ToolUseId))
+							}
+						}
+						oaiReq.Messages = append(oaiReq.Messages, OpenAIMessage{
+							Role:       "tool",
+							Content:    contentStr,
+							ToolCallID: block.ToolUseId,
+							Name:       toolIdToName[block.ToolUseId],
+						})
+						// 工具结果里的图片紧跟在对应 tool 消息之后作为 user 内容
+						if len(trImages) > 0 {
+							userParts = append(userParts, trImages...)
+							hasImage = true
 						}
-					} else {
-						contentStr = "ok"
 					}
-					oaiReq.Messages = append(oaiReq.Messages, OpenAIMessage{
-						Role:       "tool",
-						Content:    contentStr,
-						ToolCallID: tr.ToolUseId,
-						Name:       toolIdToName[tr.ToolUseId],
-					})
-				}
-
-				// 再添加 text 内容 (如果有)
-				if len(textParts) > 0 {
-					oaiReq.Messages = append(oaiReq.Messages, OpenAIMessage{
-						Role:    "user",
-						Content: strings.Join(textParts, "\n"),
-					})
 				}
+				flushUser()
 			} else {
 				// 简单字符串格式
 				text := extractText(m.Content)
@@ -615,8 +3611,8 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 
 			oaiReq.Messages = append(oaiReq.Messages, msg)
 
-		case "tool":
-			// OpenAI 格式的 tool 消息 — 直接透传
+		case "tool", "function":
+			// OpenAI 格式的 tool 消息 — 直接透传 ("function" 是旧版 OpenAI 的同义角色)
 			contentStr := extractText(m.Content)
 			oaiReq.Messages = append(oaiReq.Messages, OpenAIMessage{
 				Role:       "tool",
@@ -624,52 +3620,446 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 				ToolCallID: m.ToolCallID,
 				Name:       m.Name,
 			})
+
+		default:
+			// 未识别的角色不再静默丢弃：按 user 文本处理并警告
+			slog.Warn(fmt.Sprintf("未识别的消息角色 %q，已按 user 处理", m.Role))
+			if text := extractText(m.Content); text != "" {
+				oaiReq.Messages = append(oaiReq.Messages, OpenAIMessage{
+					Role:    "user",
+					Content: text,
+				})
+			}
 		}
 	}
 
 	// === 1.4.1 合并连续相同角色的消息（部分 OpenAI 兼容 API 不允许连续相同角色）===
-	if len(oaiReq.Messages) > 1 {
+	if mergeRoles && len(oaiReq.Messages) > 1 {
 		merged := []OpenAIMessage{oaiReq.Messages[0]}
 		for i := 1; i < len(oaiReq.Messages); i++ {
 			prev := &merged[len(merged)-1]
 			cur := oaiReq.Messages[i]
-			// 仅合并纯文本消息（无 tool_calls、无 tool_call_id）
-			if cur.Role == prev.Role &&
-				len(cur.ToolCalls) == 0 && cur.ToolCallID == "" &&
-				len(prev.ToolCalls) == 0 && prev.ToolCallID == "" {
-				// 拼接文本内容
-				prevStr, _ := prev.Content.(string)
-				curStr, _ := cur.Content.(string)
+			// 仅合并纯文本或带 tool_calls 的同角色消息（tool 消息有
+			// tool_call_id 配对约束，不参与合并）
+			prevStr, prevIsStr := prev.Content.(string)
+			curStr, curIsStr := cur.Content.(string)
+			if cur.Role == prev.Role && prevIsStr && curIsStr &&
+				cur.ToolCallID == "" && prev.ToolCallID == "" {
+				// 拼接文本内容，tool_calls 顺序串联
 				if prevStr != "" && curStr != "" {
 					prev.Content = prevStr + "\n" + curStr
 				} else if curStr != "" {
 					prev.Content = curStr
 				}
+				prev.ToolCalls = append(prev.ToolCalls, cur.ToolCalls...)
 			} else {
 				merged = append(merged, cur)
 			}
 		}
 		if debugMode && len(merged) < len(oaiReq.Messages) {
-			fmt.Printf("[DEBUG] 合并了 %d 条连续相同角色消息\n", len(oaiReq.Messages)-len(merged))
+			slog.Debug(fmt.Sprintf("合并了 %d 条连续相同角色消息", len(oaiReq.Messages)-len(merged)))
 		}
 		oaiReq.Messages = merged
 	}
 
-	// === 1.5 HTTP Client ===
-	transport := &http.Transport{}
-	if proxyURL != "" {
-		pURL, _ := url.Parse(proxyURL)
-		transport.Proxy = http.ProxyURL(pURL)
+	// === 1.4.2 历史截断（--max-history，截断点不拆散工具调用配对）===
+	if maxHistory > 0 {
+		full := oaiReq.Messages
+		oaiReq.Messages = truncateHistory(full, maxHistory)
+		// --summarize：被截掉的旧轮次压缩成一条合成 user 消息，放在 system 头之后
+		if summarizeHistory && len(oaiReq.Messages) < len(full) {
+			head := 0
+			for head < len(full) && (full[head].Role == "system" || full[head].Role == "developer") {
+				head++
+			}
+			removed := len(full) - len(oaiReq.Messages)
+			if summary := summarizeDroppedHistory(full[head:head+removed], genReq.Model, reqKey); summary != "" {
+				tail := append([]OpenAIMessage{{Role: "user", Content: "[历史摘要] " + summary}}, oaiReq.Messages[head:]...)
+				oaiReq.Messages = append(oaiReq.Messages[:head:head], tail...)
+			}
+		}
+	}
+
+	return oaiReq
+}
+
+// trailingPrefill 返回结尾的 assistant 预填文本（Anthropic 的 prefill 约定：
+// 末尾放一条未完成的 assistant 消息让模型续写）。只有纯文本的收尾
+// assistant 消息才算 prefill，带 tool_use 的是在等工具结果
+func trailingPrefill(genReq GenericRequest) string {
+	if len(genReq.Messages) == 0 {
+		return ""
+	}
+	last := genReq.Messages[len(genReq.Messages)-1]
+	if last.Role != "assistant" || len(last.ToolCalls) > 0 {
+		return ""
+	}
+	var blocks []ContentBlock
+	if err := json.Unmarshal(last.Content, &blocks); err == nil {
+		var texts []string
+		for _, b := range blocks {
+			switch b.Type {
+			case "text":
+				texts = append(texts, b.Text)
+			case "thinking", "redacted_thinking":
+				// 思考块不算可见文本
+			default:
+				return "" // 含 tool_use 等块，不是纯文本 prefill
+			}
+		}
+		return strings.Join(texts, "")
+	}
+	return extractText(last.Content)
+}
+
+// buildMiniMaxResponse 把 OpenAI 响应转换为 MiniMax/Anthropic 形状的响应体。
+// 调用前需保证 oaiResp.Choices 非空；streamTruncated 表示上游 SSE 流不完整
+func buildMiniMaxResponse(genReq GenericRequest, oaiResp OpenAIResponse, streamTruncated bool, prefill string) map[string]interface{} {
+	choice := oaiResp.Choices[0]
+	// n>1 时按 --pick 选取，不再静默丢弃多余候选
+	if len(oaiResp.Choices) > 1 {
+		idx := 0
+		if pickMode == "longest" {
+			best := -1
+			for i, c := range oaiResp.Choices {
+				n := 0
+				if c.Message.Content != nil {
+					n = len(*c.Message.Content)
+				}
+				if n > best {
+					best = n
+					idx = i
+				}
+			}
+		}
+		slog.Warn(fmt.Sprintf("上游返回 %d 个候选，按 --pick=%s 选用第 %d 个", len(oaiResp.Choices), pickMode, idx+1))
+		choice = oaiResp.Choices[idx]
+	}
+
+	var thinkingText string
+	var textContent string
+	var toolCalls []map[string]interface{}
+	var toolCallCounter int
+
+	// OpenAI-Compatible R1 的推理内容
+	if choice.Message.ReasoningContent != nil && *choice.Message.ReasoningContent != "" {
+		thinkingText = *choice.Message.ReasoningContent
+	}
+
+	// 文本内容
+	if choice.Message.Content != nil && *choice.Message.Content != "" {
+		textContent = *choice.Message.Content
+	}
+
+	// 函数调用
+	for _, tc := range choice.Message.ToolCalls {
+		toolCallCounter++
+		toolUseBlock := map[string]interface{}{
+			"type":  "tool_use",
+			"id":    tc.ID,
+			"name":  tc.Function.Name,
+			"input": json.RawMessage(tc.Function.Arguments),
+		}
+		toolCalls = append(toolCalls, toolUseBlock)
+	}
+
+	// 构建 MiniMax 格式的 content 数组
+	var contentArr []interface{}
+
+	// 1. thinking 块 (如果有推理内容)
+	if thinkingText != "" {
+		contentArr = append(contentArr, map[string]interface{}{
+			"type":     "thinking",
+			"thinking": thinkingText,
+		})
+	}
+
+	// 2. text 块 (如果有文本内容)
+	if textContent != "" {
+		// 上游不一定回显 prefill，没回显时拼回去，客户端拿到完整文本
+		if prefill != "" && !strings.HasPrefix(textContent, prefill) {
+			textContent = prefill + textContent
+		}
+		contentArr = append(contentArr, map[string]interface{}{
+			"type": "text",
+			"text": textContent,
+		})
+	}
+
+	// 3. tool_use 块 (如果有函数调用)
+	for _, tc := range toolCalls {
+		contentArr = append(contentArr, tc)
+	}
+
+	// 确定 stop_reason
+	stopReason := "end_turn"
+	if len(toolCalls) > 0 {
+		stopReason = "tool_use"
+	}
+	if streamTruncated {
+		stopReason = "truncated"
+	}
+
+	// 构建响应 (minimax 格式额外带 base_resp 封套，anthropic 格式为原生 Messages API 形状)
+	msgID := fmt.Sprintf("%x", time.Now().UnixNano())
+	if outputFormat == "anthropic" {
+		msgID = "msg_" + msgID
+	}
+	res := map[string]interface{}{
+		"id":          msgID,
+		"type":        "message",
+		"role":        "assistant",
+		"model":       genReq.Model,
+		"content":     contentArr,
+		"stop_reason": stopReason,
+		"usage": map[string]interface{}{
+			"input_tokens":  oaiResp.Usage.PromptTokens,
+			"output_tokens": oaiResp.Usage.CompletionTokens,
+		},
+	}
+	if outputFormat == "minimax" {
+		res["base_resp"] = map[string]interface{}{
+			"status_code": 0,
+			"status_msg":  "",
+		}
+	}
+
+	return res
+}
+
+func handleProxy(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+
+	// 请求标识：复用客户端的 X-Request-Id，否则生成一个短 ID，
+	// 并发请求的日志靠它关联
+	reqID := r.Header.Get("X-Request-Id")
+	if reqID == "" {
+		reqID = newRequestID()
+	}
+	w.Header().Set("X-Request-Id", reqID)
+	rlog := slog.With("request_id", reqID)
+
+	reqKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if reqKey == "" {
+		reqKey = r.Header.Get("x-api-key")
+	}
+
+	// 转发器自身的访问令牌（--relay-token）。与上游 API Key 是两回事：
+	// 令牌只证明「允许使用本转发器」，上游密钥仍按下面的流程解析
+	if relayToken != "" {
+		token := r.Header.Get("X-Relay-Token")
+		if token == "" && reqKey == relayToken {
+			// Bearer 里带的是转发器令牌而非上游密钥，消费掉并退回服务端配置的密钥
+			token = reqKey
+			reqKey = ""
+		}
+		if token != relayToken {
+			rlog.Error("转发器访问令牌缺失或不匹配，拒绝请求")
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+	}
+
+	// 入站密钥白名单（防止任何能连到端口的人白嫖上游 Key）
+	if len(clientKeys) > 0 {
+		mapped, ok := clientKeys[reqKey]
+		if !ok {
+			rlog.Error(fmt.Sprintf("未授权的客户端密钥: %s", redactSecret(reqKey)))
+			http.Error(w, "Unauthorized client key", 401)
+			return
+		}
+		if mapped != "" {
+			reqKey = mapped
+		}
+	}
+	if reqKey == "" {
+		reqKey = apiKey
+	}
+	if reqKey == "" {
+		rlog.Error("未提供 API Key (通过请求头传入)")
+		http.Error(w, "Missing API Key", 401)
+		return
+	}
+
+	// 虚拟密钥鉴别（多机器人共用一个转发器）
+	upstreamKey, vk, vkAuthorized := resolveVirtualKey(reqKey)
+	if !vkAuthorized {
+		rlog.Error(fmt.Sprintf("未知的虚拟密钥: %s", reqKey))
+		http.Error(w, "Unknown virtual key", 401)
+		return
+	}
+	reqKey = upstreamKey
+	reqLimiter := tpmLimiter
+	if vk != nil {
+		if vk.Limiter != nil {
+			reqLimiter = vk.Limiter
+		}
+		if debugMode {
+			rlog.Debug(fmt.Sprintf("虚拟密钥命中: %s", vk.Bot))
+		}
+	}
+
+	// GET /v1/models 不带聊天请求体，单独处理
+	if r.Method == "GET" && strings.HasSuffix(path, "/models") {
+		handleModels(w, reqKey)
+		return
+	}
+
+	// 其余未知路径直接 404，避免被当作聊天请求解析成 "Invalid JSON"
+	if !isChatPath(path) {
+		rlog.Error(fmt.Sprintf("不支持的路径: %s %s", r.Method, path))
+		http.Error(w, fmt.Sprintf("Unsupported path: %s", path), 404)
+		return
+	}
+
+	// 聊天路由只接受 POST + JSON，其他方法/类型直接拒绝，不再尝试解析
+	if r.Method != "POST" {
+		rlog.Error(fmt.Sprintf("不支持的方法: %s %s", r.Method, path))
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "json") {
+		rlog.Error(fmt.Sprintf("不支持的 Content-Type: %q", ct))
+		http.Error(w, "Unsupported content type, expected application/json", 415)
+		return
+	}
+
+	if maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+	bodyBytes, err := readRequestBody(r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			rlog.Error(fmt.Sprintf("请求体超过 %d 字节上限", maxBody))
+			http.Error(w, "Request body too large", 413)
+			return
+		}
+		rlog.Error(fmt.Sprintf("请求体解压失败: %v", err))
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var genReq GenericRequest
+	if err := json.Unmarshal(bodyBytes, &genReq); err != nil {
+		rlog.Error(fmt.Sprintf("JSON 解析失败: %v", err))
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	if debugMode {
+		rlog.Debug(fmt.Sprintf("%s 收到请求: %s %s | 模型: %s", time.Now().Format("15:04:05"), r.Method, path, genReq.Model))
+		rlog.Debug(fmt.Sprintf("%s 收到的数据 (Client Request):\n%s", time.Now().Format("15:04:05"), debugDump(bodyBytes)))
+	}
+
+	requestedBetas := collectBetas(r, genReq.Betas)
+
+	// === 0.3 单飞合并：相同请求体只打一次上游 ===
+	flightKey := fmt.Sprintf("%x", sha256.Sum256(bodyBytes))
+	var flightCall *inflightCall
+	for {
+		inflightMu.Lock()
+		if call, ok := inflightCalls[flightKey]; ok {
+			inflightMu.Unlock()
+			rlog.Info(fmt.Sprintf("[DEDUP] 检测到重复的在途请求，合并等待: %s", flightKey[:12]))
+			if replayInflight(w, call) {
+				return
+			}
+			// 领跑请求中止且没写响应（客户端断开），不能回放空 200，重新竞选领跑
+			rlog.Warn(fmt.Sprintf("[DEDUP] 领跑请求中止，本请求改为自行执行: %s", flightKey[:12]))
+			continue
+		}
+		flightCall = &inflightCall{done: make(chan struct{})}
+		inflightCalls[flightKey] = flightCall
+		inflightMu.Unlock()
+		break
+	}
+	defer func() {
+		flightCall.header = w.Header().Clone()
+		inflightMu.Lock()
+		delete(inflightCalls, flightKey)
+		inflightMu.Unlock()
+		// 没写过任何响应就退出（断开取消等路径直接 return），标记中止
+		if flightCall.status == 0 {
+			flightCall.aborted = true
+		}
+		close(flightCall.done)
+	}()
+	w = &inflightWriter{ResponseWriter: w, call: flightCall}
+
+	// === 0.4 注入少样本示例 ===
+	genReq.Messages = injectExamples(genReq.Messages)
+
+	// === 1. 构建 OpenAI Request ===
+	oaiReq := buildOpenAIRequest(genReq, reqKey)
+	if maxOutput > 0 && r.Header.Get("X-Relay-No-Max-Output") == "" {
+		oaiReq.MaxTokens = maxOutput
 	}
+
+	// === 1.5 HTTP Client ===
+	transport := buildProxyTransport()
 	client := &http.Client{
 		Transport: transport,
-		Timeout:   120 * time.Second,
+		Timeout:   upstreamTimeout,
+	}
+
+	// === 1.6 响应缓存查找 ===
+	cacheable := cacheMode && !genReq.Stream &&
+		(cacheAnyTemp || genReq.Temperature == nil || *genReq.Temperature == 0)
+	var respKey string
+	if cacheable {
+		respKey = responseCacheKey(&oaiReq)
+		if cached, ok := respCache.Get(respKey); ok {
+			atomic.AddInt64(&usageCacheHits, 1)
+			rlog.Info(fmt.Sprintf("[CACHE] 响应缓存命中: %s", respKey[:12]))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(cached)
+			return
+		}
+	}
+
+	// === 1.6.4 并发上限（--max-concurrent）===
+	if maxConcurrent > 0 {
+		switch acquireConcurrency(r.Context()) {
+		case admitFull:
+			rlog.Warn(fmt.Sprintf("并发已满，等待 %v 后拒绝请求", queueTimeout))
+			writeJSON(w, 503, map[string]interface{}{
+				"type": "error",
+				"error": map[string]interface{}{
+					"type":    "overloaded_error",
+					"message": fmt.Sprintf("relay at max concurrency (%d), gave up after %v in queue", maxConcurrent, queueTimeout),
+				},
+			})
+			return
+		case admitCancelled:
+			rlog.Info("客户端已断开，取消请求 (并发排队中)")
+			return
+		}
+		defer releaseConcurrency()
+	}
+
+	// === 1.6.5 入场 FIFO 队列（--queue-depth，先到先进限流段）===
+	admitted := queueDepth > 0
+	if admitted {
+		switch enterAdmissionQueue(r.Context()) {
+		case admitFull:
+			rlog.Warn("入场队列已满，拒绝请求")
+			http.Error(w, "Queue full", 503)
+			return
+		case admitCancelled:
+			rlog.Info("客户端已断开，取消请求 (入场排队中)")
+			return
+		}
+		defer func() {
+			if admitted {
+				leaveAdmissionQueue()
+			}
+		}()
 	}
 
 	// === 1.7 TPM 速率限制 ===
 	var estimatedTokens float64
 	var rawEstimate float64
-	if tpmLimiter != nil {
+	if reqLimiter != nil {
 		// 粗估：JSON payload 字节数 / 3，再乘以自适应比率修正
 		payloadSize := len(bodyBytes)
 		rawEstimate = float64(payloadSize) / 3.0
@@ -678,42 +4068,80 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 		adaptiveRatioMu.Unlock()
 
 		for {
-			allowed, waitTime := tpmLimiter.Consume(estimatedTokens)
+			allowed, waitTime := reqLimiter.Consume(estimatedTokens)
 			if allowed {
 				if debugMode {
-					fmt.Printf("[TPM] ✅ 允许请求，预估 %.0f tokens\n", estimatedTokens)
+					rlog.Info(fmt.Sprintf("[TPM] ✅ 允许请求，预估 %.0f tokens", estimatedTokens))
 				}
 				// time.Sleep(1 * time.Second)
 				break
 			}
 			if waitTime < 0 {
-				fmt.Printf("[TPM] ❌ 单次请求 %.0f tokens 超过 TPM 上限\n", estimatedTokens)
-				http.Error(w, "Request too large for TPM limit", 429)
+				rlog.Info(fmt.Sprintf("[TPM] ❌ 单次请求 %.0f tokens 超过 TPM 上限", estimatedTokens))
+				writeRelayRateLimited(w, 60, "Request too large for TPM limit")
 				return
 			}
-			fmt.Printf("[TPM] ⏳ 令牌不足，等待 %.1f 秒...\n", waitTime)
+			rlog.Info(fmt.Sprintf("[TPM] ⏳ 令牌不足，等待 %.1f 秒...", waitTime))
 			// time.Sleep(time.Duration((waitTime+1)*1000) * time.Millisecond)
-			time.Sleep(time.Duration(waitTime*1000) * time.Millisecond)
+			if !sleepCtx(r.Context(), time.Duration(waitTime*1000)*time.Millisecond) {
+				rlog.Info("客户端已断开，取消请求 (TPM 等待中)")
+				return
+			}
+			atomic.AddInt64(&throttledMillis, int64(waitTime*1000))
 		}
 	}
 
+	if admitted {
+		leaveAdmissionQueue()
+		admitted = false
+	}
+
 	// === 2. 发送请求 ===
-	targetURL := baseURL
+	targetURL := upstreamURLFor(genReq.Model)
 	payload, _ := json.Marshal(oaiReq)
 
 	if debugMode {
-		fmt.Printf("[DEBUG] %s POST %s (模型: %s)\n", time.Now().Format("15:04:05"), targetURL, genReq.Model)
-		fmt.Printf("[DEBUG] Payload:\n%s\n", string(payload))
+		rlog.Debug(fmt.Sprintf("%s POST %s (模型: %s)", time.Now().Format("15:04:05"), targetURL, genReq.Model))
+		rlog.Debug(fmt.Sprintf("Payload:\n%s", debugDump(payload)))
 	}
 
-	httpReq, _ := http.NewRequest("POST", targetURL, bytes.NewBuffer(payload))
+	// --dry-run：只打印换算结果，不真正调用上游，离线检查转换逻辑用
+	if dryRun {
+		fmt.Printf("[DRY-RUN] 将发送给 %s 的 Payload:\n%s\n", targetURL, debugDump(payload))
+		if reqLimiter != nil {
+			reqLimiter.Refund(estimatedTokens)
+		}
+		res := buildDryRunResponse(genReq.Model, payload)
+		res["id"] = reqID
+		if outputFormat == "openai" {
+			res = buildOpenAIFormatResponse(res)
+		}
+		writeJSON(w, 200, res)
+		return
+	}
+
+	httpReq, _ := http.NewRequestWithContext(r.Context(), "POST", targetURL, bytes.NewBuffer(payload))
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("Authorization", "Bearer "+reqKey)
+	applyExtraHeaders(httpReq.Header)
+	httpReq.Header.Set("X-Request-Id", reqID)
+	// OpenAI 兼容网关可能在背后代理 Claude，beta 标志原样转发
+	if len(requestedBetas) > 0 {
+		httpReq.Header.Set("anthropic-beta", strings.Join(requestedBetas, ","))
+	}
 
 	startTime := time.Now()
 	resp, err := client.Do(httpReq)
 	if err != nil {
-		fmt.Printf("[ERR] 网络连接失败: %v\n", err)
+		// 客户端主动断开和上游故障分开记：前者不是错误
+		if r.Context().Err() != nil {
+			rlog.Info("客户端已断开，上游请求中止并退还预估令牌")
+			if reqLimiter != nil {
+				reqLimiter.Refund(estimatedTokens)
+			}
+			return
+		}
+		rlog.Error(fmt.Sprintf("网络连接失败: %v", err))
 		http.Error(w, err.Error(), 502)
 		return
 	}
@@ -721,42 +4149,69 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 
 	respBody, _ := io.ReadAll(resp.Body)
 	if debugMode {
-		fmt.Printf("[DEBUG] %s 从 OpenAI-Compatible API 取得的数据 (Raw Response):\n%s\n", time.Now().Format("15:04:05"), string(respBody))
+		rlog.Debug(fmt.Sprintf("%s 从 OpenAI-Compatible API 取得的数据 (Raw Response):\n%s", time.Now().Format("15:04:05"), debugDump(respBody)))
+	}
+
+	// SSE 响应：拼装回非流式 JSON（上游提前断开时保留已拼装的部分）
+	streamTruncated := false
+	if resp.StatusCode == 200 &&
+		(strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") ||
+			bytes.HasPrefix(bytes.TrimSpace(respBody), []byte("data:"))) {
+		respBody, streamTruncated = assembleSSEResponse(respBody)
+		if streamTruncated {
+			rlog.Warn("上游 SSE 流提前断开，返回已拼装的部分内容")
+		}
 	}
 
 	if resp.StatusCode != 200 {
-		fmt.Printf("[ERR] OpenAI-Compatible 报错 (状态码 %d): %s\n", resp.StatusCode, string(respBody))
-		w.WriteHeader(resp.StatusCode)
-		w.Write(respBody)
+		rlog.Error(fmt.Sprintf("OpenAI-Compatible 报错 (状态码 %d): %s", resp.StatusCode, maskKeys(string(respBody))))
+		recordRequestMetric(genReq.Model, resp.StatusCode, time.Since(startTime))
+		if logFilePath != "" {
+			entry := map[string]interface{}{
+				"request_id":       reqID,
+				"model":            genReq.Model,
+				"messages":         len(genReq.Messages),
+				"estimated_tokens": int(estimatedTokens),
+				"upstream_status":  resp.StatusCode,
+				"latency_ms":       time.Since(startTime).Milliseconds(),
+			}
+			if vk != nil {
+				entry["bot"] = vk.Bot
+			}
+			if logBodies {
+				entry["payload"] = json.RawMessage(payload)
+				entry["response"] = strings.TrimSpace(string(respBody))
+			}
+			auditWrite(entry)
+		}
+		writeUpstreamError(w, resp.StatusCode, respBody)
 		return
 	}
 
 	// === 3. 处理响应 ===
 	var oaiResp OpenAIResponse
 	if err := json.Unmarshal(respBody, &oaiResp); err != nil {
-		fmt.Printf("[ERR] 解析 OpenAI-Compatible 响应失败: %v\n", err)
+		rlog.Error(fmt.Sprintf("解析 OpenAI-Compatible 响应失败: %v", err))
 		http.Error(w, "Failed to parse OpenAI-Compatible response", 500)
 		return
 	}
 
 	// === TPM 事后修正（双向修正 + 自适应比率更新）===
-	if tpmLimiter != nil && oaiResp.Usage.TotalTokens > 0 {
+	if reqLimiter != nil && oaiResp.Usage.TotalTokens > 0 {
 		actualTokens := float64(oaiResp.Usage.TotalTokens)
 		if actualTokens > estimatedTokens {
 			// 预估偏低，追加扣减
 			extra := actualTokens - estimatedTokens
-			tpmLimiter.ConsumeExtra(extra)
+			reqLimiter.ConsumeExtra(extra)
 			if debugMode {
-				fmt.Printf("[TPM] 修正: 预估 %.0f, 实际 %.0f, 追加扣 %.0f\n",
-					estimatedTokens, actualTokens, extra)
+				rlog.Info(fmt.Sprintf("[TPM] 修正: 预估 %.0f, 实际 %.0f, 追加扣 %.0f", estimatedTokens, actualTokens, extra))
 			}
 		} else if estimatedTokens > actualTokens {
 			// 预估偏高，退还多扣的令牌
 			refund := estimatedTokens - actualTokens
-			tpmLimiter.Refund(refund)
+			reqLimiter.Refund(refund)
 			if debugMode {
-				fmt.Printf("[TPM] 修正: 预估 %.0f, 实际 %.0f, 退还 %.0f\n",
-					estimatedTokens, actualTokens, refund)
+				rlog.Info(fmt.Sprintf("[TPM] 修正: 预估 %.0f, 实际 %.0f, 退还 %.0f", estimatedTokens, actualTokens, refund))
 			}
 		}
 
@@ -766,102 +4221,61 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 			adaptiveRatioMu.Lock()
 			adaptiveRatio = 0.8*adaptiveRatio + 0.2*newRatio
 			if debugMode {
-				fmt.Printf("[TPM] 自适应比率更新: %.4f\n", adaptiveRatio)
+				rlog.Info(fmt.Sprintf("[TPM] 自适应比率更新: %.4f", adaptiveRatio))
 			}
 			adaptiveRatioMu.Unlock()
 		}
 	}
 
 	if len(oaiResp.Choices) > 0 {
-		choice := oaiResp.Choices[0]
-
-		var thinkingText string
-		var textContent string
-		var toolCalls []map[string]interface{}
-		var toolCallCounter int
-
-		// OpenAI-Compatible R1 的推理内容
-		if choice.Message.ReasoningContent != nil && *choice.Message.ReasoningContent != "" {
-			thinkingText = *choice.Message.ReasoningContent
-		}
-
-		// 文本内容
-		if choice.Message.Content != nil && *choice.Message.Content != "" {
-			textContent = *choice.Message.Content
+		res := buildMiniMaxResponse(genReq, oaiResp, streamTruncated, trailingPrefill(genReq))
+		// 请求标识透出为响应 id，和日志/响应头对账
+		res["id"] = reqID
+		if outputFormat == "openai" {
+			res = buildOpenAIFormatResponse(res)
 		}
 
-		// 函数调用
-		for _, tc := range choice.Message.ToolCalls {
-			toolCallCounter++
-			toolUseBlock := map[string]interface{}{
-				"type":  "tool_use",
-				"id":    tc.ID,
-				"name":  tc.Function.Name,
-				"input": json.RawMessage(tc.Function.Arguments),
+		if cacheable {
+			if raw, err := json.Marshal(res); err == nil {
+				respCache.Put(respKey, raw)
 			}
-			toolCalls = append(toolCalls, toolUseBlock)
-		}
-
-		// 构建 MiniMax 格式的 content 数组
-		var contentArr []interface{}
-
-		// 1. thinking 块 (如果有推理内容)
-		if thinkingText != "" {
-			contentArr = append(contentArr, map[string]interface{}{
-				"type":     "thinking",
-				"thinking": thinkingText,
-			})
-		}
-
-		// 2. text 块 (如果有文本内容)
-		if textContent != "" {
-			contentArr = append(contentArr, map[string]interface{}{
-				"type": "text",
-				"text": textContent,
-			})
-		}
-
-		// 3. tool_use 块 (如果有函数调用)
-		for _, tc := range toolCalls {
-			contentArr = append(contentArr, tc)
-		}
-
-		// 确定 stop_reason
-		stopReason := "end_turn"
-		if len(toolCalls) > 0 {
-			stopReason = "tool_use"
-		}
-
-		// 构建 MiniMax 格式响应
-		res := map[string]interface{}{
-			"id":          fmt.Sprintf("%x", time.Now().UnixNano()),
-			"type":        "message",
-			"role":        "assistant",
-			"model":       genReq.Model,
-			"content":     contentArr,
-			"stop_reason": stopReason,
-			"usage": map[string]interface{}{
-				"input_tokens":  oaiResp.Usage.PromptTokens,
-				"output_tokens": oaiResp.Usage.CompletionTokens,
-			},
-			"base_resp": map[string]interface{}{
-				"status_code": 0,
-				"status_msg":  "",
-			},
 		}
 
 		if debugMode {
 			respBytes, _ := json.MarshalIndent(res, "", "  ")
-			fmt.Printf("[DEBUG] %s 成功响应 | 耗时: %v\n", time.Now().Format("15:04:05"), time.Since(startTime))
-			fmt.Printf("[DEBUG] %s 发送回 memubot 的数据 (Response):\n%s\n", time.Now().Format("15:04:05"), string(respBytes))
+			rlog.Debug(fmt.Sprintf("%s 成功响应 | 耗时: %v", time.Now().Format("15:04:05"), time.Since(startTime)))
+			rlog.Debug(fmt.Sprintf("%s 发送回 memubot 的数据 (Response):\n%s", time.Now().Format("15:04:05"), debugDump(respBytes)))
+		}
+		recordRequestMetric(genReq.Model, 200, time.Since(startTime))
+		atomic.AddInt64(&usageRequests, 1)
+		atomic.AddInt64(&usageInputTokens, int64(oaiResp.Usage.PromptTokens))
+		atomic.AddInt64(&usageOutputTokens, int64(oaiResp.Usage.CompletionTokens))
+		recordCost(genReq.Model, oaiResp.Usage.PromptTokens, oaiResp.Usage.CompletionTokens, 0)
+		recordConvUsage(usageScope(r, systemText(genReq.System)), oaiResp.Usage.PromptTokens, oaiResp.Usage.CompletionTokens, 0)
+
+		if logFilePath != "" {
+			entry := map[string]interface{}{
+				"request_id":       reqID,
+				"model":            genReq.Model,
+				"messages":         len(genReq.Messages),
+				"estimated_tokens": int(estimatedTokens),
+				"actual_tokens":    oaiResp.Usage.TotalTokens,
+				"upstream_status":  200,
+				"latency_ms":       time.Since(startTime).Milliseconds(),
+			}
+			if vk != nil {
+				entry["bot"] = vk.Bot
+			}
+			if logBodies {
+				entry["payload"] = json.RawMessage(payload)
+				entry["response"] = json.RawMessage(respBody)
+			}
+			auditWrite(entry)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		enc := json.NewEncoder(w)
-		enc.SetEscapeHTML(false)
-		enc.Encode(res)
+		writeJSON(w, 200, res)
 	} else {
 		// No choices
-		fmt.Printf("[ERR] OpenAI-Compatible returned no choices. 原始响应: %s\n", string(respBody))
+		rlog.Error(fmt.Sprintf("OpenAI-Compatible returned no choices. 原始响应: %s", string(respBody)))
 		http.Error(w, "OpenAI-Compatible returned no choices", 500)
 	}
 }
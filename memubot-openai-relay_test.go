@@ -0,0 +1,478 @@
+//go:build openai
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试不经过 main 的 flag.Parse，这里补上被测路径依赖的默认值
+func TestMain(m *testing.M) {
+	outputFormat = "minimax"
+	mergeRoles = true
+	systemRole = "auto"
+	os.Exit(m.Run())
+}
+
+func mustMessages(t *testing.T, raw string) []GenericMessage {
+	t.Helper()
+	var msgs []GenericMessage
+	if err := json.Unmarshal([]byte(raw), &msgs); err != nil {
+		t.Fatalf("消息 fixture 解析失败: %v", err)
+	}
+	return msgs
+}
+
+func mustTools(t *testing.T, raw string) []GenericTool {
+	t.Helper()
+	var tools []GenericTool
+	if err := json.Unmarshal([]byte(raw), &tools); err != nil {
+		t.Fatalf("工具 fixture 解析失败: %v", err)
+	}
+	return tools
+}
+
+// --- 请求转换 (buildOpenAIRequest) ---
+
+func TestBuildOpenAIRequestTools(t *testing.T) {
+	cases := []struct {
+		name  string
+		tools string
+	}{
+		{
+			"openai-style",
+			`[{"type":"function","function":{"name":"get_weather","description":"查询城市天气","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}}]`,
+		},
+		{
+			"anthropic-style",
+			`[{"name":"get_weather","description":"查询城市天气","input_schema":{"type":"object","properties":{"city":{"type":"string"}}}}]`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			genReq := GenericRequest{
+				Model:    "deepseek-ai/DeepSeek-V3",
+				Messages: mustMessages(t, `[{"role":"user","content":"北京天气如何"}]`),
+				Tools:    mustTools(t, tc.tools),
+			}
+			oaiReq := buildOpenAIRequest(genReq, "")
+			if len(oaiReq.Tools) != 1 {
+				t.Fatalf("期望 1 个工具定义，得到 %+v", oaiReq.Tools)
+			}
+			td := oaiReq.Tools[0]
+			if td.Type != "function" || td.Function.Name != "get_weather" {
+				t.Errorf("工具定义 = %+v，期望 function/get_weather", td)
+			}
+			var params map[string]any
+			if err := json.Unmarshal(td.Function.Parameters, &params); err != nil {
+				t.Fatalf("参数 schema 不是合法 JSON: %v", err)
+			}
+			if _, ok := params["properties"]; !ok {
+				t.Errorf("参数 schema 丢失 properties: %s", td.Function.Parameters)
+			}
+		})
+	}
+}
+
+func TestBuildOpenAIRequestToolResultMapping(t *testing.T) {
+	genReq := GenericRequest{
+		Model: "deepseek-ai/DeepSeek-V3",
+		Messages: mustMessages(t, `[
+			{"role":"user","content":"北京天气如何"},
+			{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}]},
+			{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":"晴 25 度"}]}
+		]`),
+	}
+	oaiReq := buildOpenAIRequest(genReq, "")
+	if len(oaiReq.Messages) != 3 {
+		t.Fatalf("期望 3 条消息，得到 %d: %+v", len(oaiReq.Messages), oaiReq.Messages)
+	}
+	asst := oaiReq.Messages[1]
+	if asst.Role != "assistant" || len(asst.ToolCalls) != 1 || asst.ToolCalls[0].Function.Name != "get_weather" {
+		t.Errorf("tool_use 应转为 assistant tool_calls: %+v", asst)
+	}
+	toolMsg := oaiReq.Messages[2]
+	if toolMsg.Role != "tool" || toolMsg.ToolCallID != "call_1" {
+		t.Errorf("tool_result 应转为 tool 消息并带 tool_call_id: %+v", toolMsg)
+	}
+	if toolMsg.Name != "get_weather" {
+		t.Errorf("tool 消息应按 tool_use_id 映射回函数名，得到 %q", toolMsg.Name)
+	}
+	if toolMsg.Content != "晴 25 度" {
+		t.Errorf("tool 消息内容 = %v", toolMsg.Content)
+	}
+}
+
+func TestBuildOpenAIRequestMergesConsecutiveRoles(t *testing.T) {
+	genReq := GenericRequest{
+		Model: "deepseek-ai/DeepSeek-V3",
+		Messages: mustMessages(t, `[
+			{"role":"user","content":"第一句"},
+			{"role":"user","content":"第二句"},
+			{"role":"assistant","content":"好的"},
+			{"role":"assistant","content":"请继续"}
+		]`),
+	}
+	oaiReq := buildOpenAIRequest(genReq, "")
+	if len(oaiReq.Messages) != 2 {
+		t.Fatalf("连续相同角色应合并为 2 条消息，得到 %d: %+v", len(oaiReq.Messages), oaiReq.Messages)
+	}
+	if oaiReq.Messages[0].Content != "第一句\n第二句" {
+		t.Errorf("user 合并结果 = %v", oaiReq.Messages[0].Content)
+	}
+	if oaiReq.Messages[1].Content != "好的\n请继续" {
+		t.Errorf("assistant 合并结果 = %v", oaiReq.Messages[1].Content)
+	}
+}
+
+func TestBuildOpenAIRequestSystemRole(t *testing.T) {
+	genReq := GenericRequest{
+		Model:    "deepseek-ai/DeepSeek-V3",
+		System:   json.RawMessage(`"保持简短"`),
+		Messages: mustMessages(t, `[{"role":"user","content":"ping"}]`),
+	}
+	oaiReq := buildOpenAIRequest(genReq, "")
+	if len(oaiReq.Messages) != 2 || oaiReq.Messages[0].Role != "system" || oaiReq.Messages[0].Content != "保持简短" {
+		t.Fatalf("system 字段应转为首条 system 消息: %+v", oaiReq.Messages)
+	}
+}
+
+// --- 工具声明驻留注册表 (internToolDeclaration) ---
+
+// 驻留命中的声明必须与直接处理的结果逐字节一致，出站 payload 不能因缓存而变
+func TestInternToolDeclarationGolden(t *testing.T) {
+	schema := json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"}},"required":["path"]}`)
+	direct := processToolDeclaration("fs_read", "读取文件", schema)
+	interned := internToolDeclaration("fs_read", "读取文件", schema)
+	cached := internToolDeclaration("fs_read", "读取文件", schema)
+
+	want, _ := json.Marshal(direct)
+	for _, d := range []OpenAIToolDef{interned, cached} {
+		got, _ := json.Marshal(d)
+		if string(got) != string(want) {
+			t.Errorf("驻留声明与直接处理不一致:\n直接: %s\n驻留: %s", want, got)
+		}
+	}
+}
+
+// benchToolFixture 造一个 60 工具的请求样例，模拟大型 memU 配置
+func benchToolFixture() []GenericTool {
+	tools := make([]GenericTool, 60)
+	for i := range tools {
+		tools[i].Name = fmt.Sprintf("tool_%02d", i)
+		tools[i].Description = "基准测试工具"
+		tools[i].InputSchema = json.RawMessage(fmt.Sprintf(
+			`{"type":"object","properties":{"arg_%02d":{"type":"string"},"count":{"type":"integer"}},"required":["arg_%02d"]}`, i, i))
+	}
+	return tools
+}
+
+func BenchmarkInternToolDeclaration60Tools(b *testing.B) {
+	tools := benchToolFixture()
+	// 预热：第一轮请求完成登记，基准测量的是后续请求的命中路径
+	for _, tl := range tools {
+		internToolDeclaration(tl.Name, tl.Description, tl.InputSchema)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tl := range tools {
+			internToolDeclaration(tl.Name, tl.Description, tl.InputSchema)
+		}
+	}
+}
+
+func BenchmarkProcessToolDeclaration60Tools(b *testing.B) {
+	tools := benchToolFixture()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tl := range tools {
+			processToolDeclaration(tl.Name, tl.Description, tl.InputSchema)
+		}
+	}
+}
+
+// --- 空参数 schema 归一化 (processToolDeclaration) ---
+
+// 部分供应商要求 parameters 非 null：nil/null 补空 object schema，其余原样保留
+func TestEmptySchemaNormalization(t *testing.T) {
+	cases := []struct {
+		name        string
+		params      string // "" 表示 nil
+		wantDefault bool
+	}{
+		{"nil", "", true},
+		{"null", "null", true},
+		{"empty-object", "{}", false},
+		{"bare-type", `{"type":"object"}`, false},
+		{"with-properties", `{"type":"object","properties":{"city":{"type":"string"}}}`, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var params json.RawMessage
+			if tc.params != "" {
+				params = json.RawMessage(tc.params)
+			}
+			decl := processToolDeclaration("probe", "", params)
+			if decl.Function.Parameters == nil {
+				t.Fatalf("parameters 不能为 null: %+v", decl)
+			}
+			if tc.wantDefault {
+				if string(decl.Function.Parameters) != `{"type":"object","properties":{}}` {
+					t.Errorf("nil/null schema 应补空 object schema，得到 %s", decl.Function.Parameters)
+				}
+			} else if string(decl.Function.Parameters) != tc.params {
+				t.Errorf("非空 schema 应原样保留: %s → %s", tc.params, decl.Function.Parameters)
+			}
+		})
+	}
+}
+
+// --- 非标准角色 (developer / function) ---
+
+// developer 原样透传，function 与 tool 同义、都转 tool 消息
+func TestRoleMixTranscript(t *testing.T) {
+	msgs := mustMessages(t, `[
+		{"role":"developer","content":"只回答天气问题"},
+		{"role":"user","content":"北京天气如何"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}}]},
+		{"role":"tool","tool_call_id":"call_1","name":"get_weather","content":"晴"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"call_2","name":"get_weather","input":{"city":"上海"}}]},
+		{"role":"function","tool_call_id":"call_2","name":"get_weather","content":"多云"}
+	]`)
+	oaiReq := buildOpenAIRequest(GenericRequest{Model: "deepseek-ai/DeepSeek-V3", Messages: msgs}, "")
+	if len(oaiReq.Messages) != 6 {
+		t.Fatalf("期望 6 条消息，得到 %d: %+v", len(oaiReq.Messages), oaiReq.Messages)
+	}
+	if oaiReq.Messages[0].Role != "developer" || oaiReq.Messages[0].Content != "只回答天气问题" {
+		t.Errorf("developer 消息应原样透传: %+v", oaiReq.Messages[0])
+	}
+	for _, tc := range []struct {
+		idx    int
+		callID string
+	}{{3, "call_1"}, {5, "call_2"}} {
+		m := oaiReq.Messages[tc.idx]
+		if m.Role != "tool" || m.ToolCallID != tc.callID || m.Name != "get_weather" {
+			t.Errorf("第 %d 条应是 tool 消息 (%s): %+v", tc.idx, tc.callID, m)
+		}
+	}
+}
+
+// --- 坏 JSON 修复 (fixJSON) ---
+
+// 来自真实坏工具参数的样本：裸 key、单引号、尾逗号、以及各种不能误伤的写法
+func TestFixJSONMalformedSamples(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want map[string]any
+	}{
+		{
+			"bare-keys",
+			`{path: "/tmp/a.txt", recursive: true}`,
+			map[string]any{"path": "/tmp/a.txt", "recursive": true},
+		},
+		{
+			"single-quoted",
+			`{'path': '/tmp/a.txt'}`,
+			map[string]any{"path": "/tmp/a.txt"},
+		},
+		{
+			"trailing-comma-object",
+			`{"a": 1,}`,
+			map[string]any{"a": float64(1)},
+		},
+		{
+			"trailing-comma-nested-array",
+			`{"cmd": ["ls", "-la",], "cwd": "/tmp",}`,
+			map[string]any{"cmd": []any{"ls", "-la"}, "cwd": "/tmp"},
+		},
+		{
+			"escaped-single-quote",
+			`{'msg': 'it\'s done'}`,
+			map[string]any{"msg": "it's done"},
+		},
+		{
+			"double-quote-inside-single",
+			`{'msg': 'say "hi"'}`,
+			map[string]any{"msg": `say "hi"`},
+		},
+		{
+			"mixed-everything",
+			`{query: 'select * from t', limit: 10, dry_run: false,}`,
+			map[string]any{"query": "select * from t", "limit": float64(10), "dry_run": false},
+		},
+		{
+			"valid-json-untouched",
+			`{"text": "带逗号, 和 {花括号} 的内容", "n": 1}`,
+			map[string]any{"text": "带逗号, 和 {花括号} 的内容", "n": float64(1)},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fixed := fixJSON(tc.in)
+			var got map[string]any
+			if err := json.Unmarshal([]byte(fixed), &got); err != nil {
+				t.Fatalf("修复结果仍不是合法 JSON: %v\n输入: %s\n输出: %s", err, tc.in, fixed)
+			}
+			wantJSON, _ := json.Marshal(tc.want)
+			gotJSON, _ := json.Marshal(got)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("解析结果 = %s，期望 %s (输入 %s)", gotJSON, wantJSON, tc.in)
+			}
+		})
+	}
+}
+
+// --- 交错顺序的 text / tool_result 块 (黄金用例) ---
+
+// user 消息里注释文本和 tool_result 交错时，转换必须按原始块顺序
+// 输出 user / tool 消息，不能把 tool_result 全提到前面
+func TestInterleavedBlockOrderGolden(t *testing.T) {
+	msgs := mustMessages(t, `[
+		{"role":"user","content":"查两个城市"},
+		{"role":"assistant","content":[
+			{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"北京"}},
+			{"type":"tool_use","id":"call_2","name":"get_weather","input":{"city":"上海"}}
+		]},
+		{"role":"user","content":[
+			{"type":"text","text":"第一个结果:"},
+			{"type":"tool_result","tool_use_id":"call_1","content":"晴"},
+			{"type":"text","text":"第二个结果:"},
+			{"type":"tool_result","tool_use_id":"call_2","content":"多云"},
+			{"type":"text","text":"请汇总。"}
+		]}
+	]`)
+	oaiReq := buildOpenAIRequest(GenericRequest{Model: "deepseek-ai/DeepSeek-V3", Messages: msgs}, "")
+
+	type golden struct {
+		role       string
+		content    string
+		toolCallID string
+	}
+	want := []golden{
+		{"user", "查两个城市", ""},
+		{"assistant", "", ""},
+		{"user", "第一个结果:", ""},
+		{"tool", "晴", "call_1"},
+		{"user", "第二个结果:", ""},
+		{"tool", "多云", "call_2"},
+		{"user", "请汇总。", ""},
+	}
+	if len(oaiReq.Messages) != len(want) {
+		t.Fatalf("期望 %d 条消息，得到 %d: %+v", len(want), len(oaiReq.Messages), oaiReq.Messages)
+	}
+	for i, w := range want {
+		m := oaiReq.Messages[i]
+		if m.Role != w.role || m.ToolCallID != w.toolCallID {
+			t.Errorf("第 %d 条 = %s/%s，期望 %s/%s", i, m.Role, m.ToolCallID, w.role, w.toolCallID)
+		}
+		if w.content != "" {
+			if got, _ := m.Content.(string); got != w.content {
+				t.Errorf("第 %d 条内容 = %v，期望 %q", i, m.Content, w.content)
+			}
+		}
+	}
+}
+
+// tool_result 块数组：文本拼接进 tool 消息，图片挪到随后的 user 消息
+func TestToolResultArrayOfBlocks(t *testing.T) {
+	msgs := mustMessages(t, `[
+		{"role":"user","content":"截个图"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"screenshot","input":{}}]},
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":[
+			{"type":"text","text":"已截图"},
+			{"type":"text","text":"分辨率 1920x1080"},
+			{"type":"image","source":{"type":"base64","media_type":"image/png","data":"aGk="}}
+		]}]}
+	]`)
+	oaiReq := buildOpenAIRequest(GenericRequest{Model: "deepseek-ai/DeepSeek-V3", Messages: msgs}, "")
+	if len(oaiReq.Messages) != 4 {
+		t.Fatalf("期望 4 条消息 (user/assistant/tool/user 图片)，得到 %d: %+v", len(oaiReq.Messages), oaiReq.Messages)
+	}
+	toolMsg := oaiReq.Messages[2]
+	if toolMsg.Role != "tool" || toolMsg.Content != "已截图\n分辨率 1920x1080" {
+		t.Errorf("文本块应换行拼接进 tool 消息: %+v", toolMsg)
+	}
+	imgMsg := oaiReq.Messages[3]
+	parts, ok := imgMsg.Content.([]map[string]interface{})
+	if imgMsg.Role != "user" || !ok || len(parts) != 1 || parts[0]["type"] != "image_url" {
+		t.Errorf("图片应作为随后的 user content-part: %+v", imgMsg)
+	}
+}
+
+// --- WebSocket 并发帧 (集成) ---
+
+// 用 memubot-ws-client.go 的客户端在同一条连接上并发打 10 个请求帧，
+// 验证每帧都拿到自己 id 对应的完整响应
+func TestWSConcurrentFrames(t *testing.T) {
+	stub := &conformanceStub{}
+	upLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("桩上游监听失败: %v", err)
+	}
+	defer upLn.Close()
+	upMux := http.NewServeMux()
+	upMux.HandleFunc("/", stub.handler)
+	go http.Serve(upLn, upMux)
+	oldBase, oldKey := baseURL, apiKey
+	baseURL = "http://" + upLn.Addr().String() + "/v1/chat/completions"
+	apiKey = "sk-ws-test"
+	defer func() { baseURL, apiKey = oldBase, oldKey }()
+
+	wsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("WS 监听失败: %v", err)
+	}
+	defer wsLn.Close()
+	wsMux := http.NewServeMux()
+	wsMux.HandleFunc("/v1/ws", handleWS)
+	go http.Serve(wsLn, wsMux)
+
+	c, err := dialWSClient(wsLn.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("WS 握手失败: %v", err)
+	}
+	defer c.close()
+
+	const frames = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, frames)
+	for i := 0; i < frames; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("frame-%d", i)
+			body := fmt.Sprintf(`{"model":%q,"messages":[{"role":"user","content":"ping %d"}]}`, fixtureChatModel, i)
+			reply, err := c.call(id, []byte(body), 30*time.Second)
+			if err != nil {
+				errs <- fmt.Errorf("%s: %v", id, err)
+				return
+			}
+			if reply.Id != id || reply.Status != 200 || reply.Error != "" {
+				errs <- fmt.Errorf("%s: 响应异常 id=%s status=%d error=%q", id, reply.Id, reply.Status, reply.Error)
+				return
+			}
+			if !strings.Contains(string(reply.Response), "pong") {
+				errs <- fmt.Errorf("%s: 响应缺少正文: %s", id, reply.Response)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if stub.count() < frames {
+		t.Errorf("桩上游只收到 %d 次调用，期望至少 %d", stub.count(), frames)
+	}
+}
@@ -0,0 +1,197 @@
+//go:build gemini || openai
+
+package main
+
+// === WebSocket 测试客户端 ===
+// /v1/ws 的最小客户端，供集成测试和脚本驱动转发器用：负责升级握手、
+// 按 RFC 6455 掩码发帧，并按帧里的 id 把响应分发回各自的等待方，
+// 因此可以在同一条连接上并发发多个请求帧。帧读取直接复用服务端的
+// wsReadFrame（服务端回帧不带掩码，读逻辑通用）。
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// wsClientReply 是服务端响应帧的信封，对应 serveWSFrame 的输出
+type wsClientReply struct {
+	Id       string          `json:"id"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+	Error    string          `json:"error"`
+}
+
+type wsClient struct {
+	conn    net.Conn
+	rw      *bufio.ReadWriter
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan wsClientReply
+	readErr error
+	closed  bool
+}
+
+// dialWSClient 连接 hostport 上的 /v1/ws 并完成升级握手；header 里的
+// Authorization 等会随升级请求带上（之后所有帧共享这组头）
+func dialWSClient(hostport string, header http.Header) (*wsClient, error) {
+	conn, err := net.DialTimeout("tcp", hostport, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	wsKey := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req, _ := http.NewRequest("GET", "http://"+hostport+"/v1/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", wsKey)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if err := req.Write(rw); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rw.Flush()
+	resp, err := http.ReadResponse(rw.Reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != 101 {
+		conn.Close()
+		return nil, fmt.Errorf("升级失败: HTTP %d", resp.StatusCode)
+	}
+
+	c := &wsClient{conn: conn, rw: rw, pending: map[string]chan wsClientReply{}}
+	go c.readLoop()
+	return c, nil
+}
+
+// writeFrame 写出一个带掩码的客户端帧（服务端要求客户端帧必须掩码）
+func (c *wsClient) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	header := []byte{0x80 | opcode}
+	n := len(payload)
+	switch {
+	case n < 126:
+		header = append(header, 0x80|byte(n))
+	case n < 1<<16:
+		header = append(header, 0x80|126, byte(n>>8), byte(n))
+	default:
+		return fmt.Errorf("帧过大: %d 字节", n)
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	header = append(header, mask...)
+	masked := make([]byte, n)
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(masked); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// readLoop 持续读服务端帧，按 id 分发给等待方；连接断开时叫醒所有人
+func (c *wsClient) readLoop() {
+	for {
+		op, payload, err := wsReadFrame(c.rw.Reader)
+		if err != nil {
+			c.failAll(err)
+			return
+		}
+		switch op {
+		case 0x8: // close
+			c.failAll(fmt.Errorf("服务端关闭连接"))
+			return
+		case 0x9: // ping
+			c.writeFrame(0xA, payload)
+		case 0x1, 0x2:
+			var reply wsClientReply
+			if json.Unmarshal(payload, &reply) != nil {
+				continue
+			}
+			c.mu.Lock()
+			ch := c.pending[reply.Id]
+			delete(c.pending, reply.Id)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- reply
+			}
+		}
+	}
+}
+
+func (c *wsClient) failAll(err error) {
+	c.mu.Lock()
+	c.readErr = err
+	for id, ch := range c.pending {
+		delete(c.pending, id)
+		close(ch)
+	}
+	c.mu.Unlock()
+}
+
+// call 发送一个 {id, request} 请求帧并阻塞等待同 id 的响应帧
+func (c *wsClient) call(id string, request []byte, timeout time.Duration) (wsClientReply, error) {
+	ch := make(chan wsClientReply, 1)
+	c.mu.Lock()
+	if c.readErr != nil {
+		err := c.readErr
+		c.mu.Unlock()
+		return wsClientReply{}, err
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	frame, _ := json.Marshal(map[string]interface{}{"id": id, "request": json.RawMessage(request)})
+	if err := c.writeFrame(0x1, frame); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return wsClientReply{}, err
+	}
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return wsClientReply{}, fmt.Errorf("连接已断开: %v", c.readErr)
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return wsClientReply{}, fmt.Errorf("等待帧 %s 超时", id)
+	}
+}
+
+func (c *wsClient) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.mu.Unlock()
+	c.writeFrame(0x8, nil)
+	c.conn.Close()
+}